@@ -0,0 +1,94 @@
+package l7proxify
+
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license which can be found in the LICENSE file.
+
+import "strconv"
+
+type alert uint8
+
+// alert level, only fatal alerts are sent so the warning level isn't needed
+const alertLevelError = 2
+
+const (
+	alertCloseNotify            alert = 0
+	alertUnexpectedMessage      alert = 10
+	alertBadRecordMAC           alert = 20
+	alertDecryptionFailed       alert = 21
+	alertRecordOverflow         alert = 22
+	alertDecompressionFailure   alert = 30
+	alertHandshakeFailure       alert = 40
+	alertBadCertificate         alert = 42
+	alertUnsupportedCertificate alert = 43
+	alertCertificateRevoked     alert = 44
+	alertCertificateExpired     alert = 45
+	alertCertificateUnknown     alert = 46
+	alertIllegalParameter       alert = 47
+	alertUnknownCA              alert = 48
+	alertAccessDenied           alert = 49
+	alertDecodeError            alert = 50
+	alertDecryptError           alert = 51
+	alertProtocolVersion        alert = 70
+	alertInsufficientSecurity   alert = 71
+	alertInternalError          alert = 80
+	alertInappropriateFallback  alert = 86
+	alertUserCanceled           alert = 90
+	alertNoRenegotiation        alert = 100
+	alertUnrecognizedName       alert = 112
+	alertNoApplicationProtocol  alert = 120
+)
+
+// alertNames the names used for alerts in configuration, these come from RFC
+// 5246 and RFC 8446.
+var alertNames = map[alert]string{
+	alertCloseNotify:            "close_notify",
+	alertUnexpectedMessage:      "unexpected_message",
+	alertBadRecordMAC:           "bad_record_mac",
+	alertDecryptionFailed:       "decryption_failed",
+	alertRecordOverflow:         "record_overflow",
+	alertDecompressionFailure:   "decompression_failure",
+	alertHandshakeFailure:       "handshake_failure",
+	alertBadCertificate:         "bad_certificate",
+	alertUnsupportedCertificate: "unsupported_certificate",
+	alertCertificateRevoked:     "certificate_revoked",
+	alertCertificateExpired:     "certificate_expired",
+	alertCertificateUnknown:     "certificate_unknown",
+	alertIllegalParameter:       "illegal_parameter",
+	alertUnknownCA:              "unknown_ca",
+	alertAccessDenied:           "access_denied",
+	alertDecodeError:            "decode_error",
+	alertDecryptError:           "decrypt_error",
+	alertProtocolVersion:        "protocol_version",
+	alertInsufficientSecurity:   "insufficient_security",
+	alertInternalError:          "internal_error",
+	alertInappropriateFallback:  "inappropriate_fallback",
+	alertUserCanceled:           "user_canceled",
+	alertNoRenegotiation:        "no_renegotiation",
+	alertUnrecognizedName:       "unrecognized_name",
+	alertNoApplicationProtocol:  "no_application_protocol",
+}
+
+func (e alert) String() string {
+	s, ok := alertNames[e]
+	if ok {
+		return s
+	}
+	return "alert(" + strconv.Itoa(int(e)) + ")"
+}
+
+// parseAlert look up an alert using the name from configuration, the alerts
+// which aren't errors are refused as they can't be sent at the fatal level.
+func parseAlert(name string) (alert, bool) {
+	for a, s := range alertNames {
+		if s != name {
+			continue
+		}
+		switch a {
+		case alertCloseNotify, alertUserCanceled, alertNoRenegotiation:
+			return 0, false
+		}
+		return a, true
+	}
+	return 0, false
+}
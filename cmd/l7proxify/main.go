@@ -6,11 +6,17 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
 	"github.com/apex/log/handlers/json"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/wolfeidau/l7proxify"
@@ -49,29 +55,120 @@ var (
 			log.WithField("json", viper.Get("logging.json")).Info("logging")
 			log.WithField("localAddr", viper.Get("localAddr")).Info("listen")
 
-			rules := viper.GetStringMap("rules")
+			dialMode, err := l7proxify.ParseDialMode(viper.GetString("dialMode"))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-1)
+			}
+
+			verifySNI, err := l7proxify.ParseSNIVerify(viper.GetString("verifySNI"))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-1)
+			}
+
+			hiddenCert, err := l7proxify.ParseCertPolicy(viper.GetString("hiddenCert"))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-1)
+			}
+
+			var parentProxy *url.URL
+
+			if viper.GetString("parentProxy") != "" {
+				parentProxy, err = l7proxify.ParseParentProxy(viper.GetString("parentProxy"))
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(-1)
+				}
+			}
+
+			log.WithFields(log.Fields{
+				"dialMode":    viper.Get("dialMode"),
+				"dialPort":    viper.Get("dialPort"),
+				"transparent": viper.Get("transparent"),
+				"spoofSource": viper.Get("spoofSource"),
+				"verifySNI":   viper.Get("verifySNI"),
+				"hiddenCert":  viper.Get("hiddenCert"),
+				"parentProxy": redacted(parentProxy),
+			}).Info("dial")
+
+			log.WithField("monitor", viper.Get("monitor")).Info("policy")
+
+			ruleset := &l7proxify.Ruleset{}
 
-			err = l7proxify.LoadRuleset(rules)
+			err = ruleset.LoadConfig(rulesetConfig())
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(-1)
 			}
 
-			l7proxify.ListenAndServe(viper.GetString("localAddr"), &l7proxify.TLSHandler{})
+			handler := &l7proxify.TLSHandler{
+				Ruleset:     ruleset,
+				DialMode:    dialMode,
+				DialPort:    viper.GetInt("dialPort"),
+				Transparent: viper.GetBool("transparent"),
+				SpoofSource: viper.GetBool("spoofSource"),
+				VerifySNI:   verifySNI,
+				HiddenCert:  hiddenCert,
+				Monitor:     viper.GetBool("monitor"),
+				ParentProxy: parentProxy,
+			}
+
+			srv := &l7proxify.Server{
+				Addr:        viper.GetString("localAddr"),
+				Handler:     handler,
+				Transparent: viper.GetBool("transparent"),
+			}
+
+			warnDestinations(handler)
+
+			// from here on only the reload goroutine reads the config
+			watchRuleset(handler)
+
+			err = srv.ListenAndServe()
+			if err != nil {
+				log.WithError(err).Error("listen failed")
+				os.Exit(-1)
+			}
 		},
 	}
 
 	rootOpts struct {
-		Debug     bool
-		LocalAddr string
+		Debug       bool
+		LocalAddr   string
+		DialMode    string
+		DialPort    int
+		Transparent bool
+		SpoofSource bool
+		VerifySNI   string
+		HiddenCert  string
+		Monitor     bool
+		ParentProxy string
 	}
 )
 
 func init() {
 	cmdRoot.PersistentFlags().BoolVar(&rootOpts.Debug, "debug", false, "Log debug information.")
 	cmdRoot.PersistentFlags().StringVar(&rootOpts.LocalAddr, "localAddr", "localhost:13131", "Local listen address.")
+	cmdRoot.PersistentFlags().StringVar(&rootOpts.DialMode, "dialMode", "sni", "Upstream dial mode, one of sni, sni-origport or origdst.")
+	cmdRoot.PersistentFlags().IntVar(&rootOpts.DialPort, "dialPort", 443, "Upstream port used with the sni dial mode.")
+	cmdRoot.PersistentFlags().BoolVar(&rootOpts.Transparent, "transparent", false, "Accept connections redirected with TPROXY.")
+	cmdRoot.PersistentFlags().BoolVar(&rootOpts.SpoofSource, "spoofSource", false, "Use the client address as the source of upstream connections.")
+	cmdRoot.PersistentFlags().StringVar(&rootOpts.VerifySNI, "verifySNI", "off", "Check the SNI hostname resolves to the original destination, one of off, log or reject.")
+	cmdRoot.PersistentFlags().StringVar(&rootOpts.HiddenCert, "hiddenCert", "allow", "Action when the server certificate can't be validated, one of allow or deny.")
+	cmdRoot.PersistentFlags().BoolVar(&rootOpts.Monitor, "monitor", false, "Log connections the rules would reject but accept them.")
+	cmdRoot.PersistentFlags().StringVar(&rootOpts.ParentProxy, "parentProxy", "", "Make upstream connections through a parent proxy, http://host:port or socks5://host:port.")
 	viper.BindPFlag("debug", cmdRoot.PersistentFlags().Lookup("debug"))
 	viper.BindPFlag("localAddr", cmdRoot.PersistentFlags().Lookup("localAddr"))
+	viper.BindPFlag("dialMode", cmdRoot.PersistentFlags().Lookup("dialMode"))
+	viper.BindPFlag("dialPort", cmdRoot.PersistentFlags().Lookup("dialPort"))
+	viper.BindPFlag("transparent", cmdRoot.PersistentFlags().Lookup("transparent"))
+	viper.BindPFlag("spoofSource", cmdRoot.PersistentFlags().Lookup("spoofSource"))
+	viper.BindPFlag("verifySNI", cmdRoot.PersistentFlags().Lookup("verifySNI"))
+	viper.BindPFlag("hiddenCert", cmdRoot.PersistentFlags().Lookup("hiddenCert"))
+	viper.BindPFlag("monitor", cmdRoot.PersistentFlags().Lookup("monitor"))
+	viper.BindPFlag("parentProxy", cmdRoot.PersistentFlags().Lookup("parentProxy"))
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/l7proxify/")
 	viper.AddConfigPath("$HOME/.l7proxify")
@@ -79,6 +176,217 @@ func init() {
 	viper.SetConfigType("toml")
 }
 
+// redacted the parent proxy URL without the password, or empty when not set
+func redacted(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// rulesetConfig the rules, client groups and default action from the config
+// file
+func rulesetConfig() l7proxify.RulesetConfig {
+	return l7proxify.RulesetConfig{
+		Rules:         viper.GetStringMap("rules"),
+		Groups:        viper.GetStringMap("groups"),
+		DefaultAction: viper.GetString("default_action"),
+	}
+}
+
+// reloadDelay how long file changes are collected before the ruleset is
+// reloaded, editors and config tools often truncate a file and then write it
+// so the first event can see it empty or part written
+const reloadDelay = 500 * time.Millisecond
+
+// watchRuleset reload the ruleset when the process receives SIGHUP, the
+// config file changes or one of the domain lists used by the rules changes. If
+// the new config is invalid the existing rules are kept.
+//
+// File changes are coalesced, the reload happens once no more have arrived
+// for reloadDelay.
+//
+// viper isn't safe for concurrent use so a single goroutine handles every
+// reload and is the only one to read the config once this is called.
+func watchRuleset(handler *l7proxify.TLSHandler) {
+
+	ruleset := handler.Ruleset
+
+	configFile := viper.ConfigFileUsed()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("failed to watch config and domain lists")
+	}
+
+	dirs := &watchedDirs{watcher: watcher, dirs: map[string]bool{}}
+	dirs.watch(append([]string{configFile}, ruleset.Files()...))
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// nil channels block so without a watcher only SIGHUP reloads
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	// reload fires once the file changes settle, nil when none are pending
+	var (
+		reload     <-chan time.Time
+		reason     string
+		readConfig bool
+	)
+
+	go func() {
+		for {
+			select {
+			case <-sighup:
+				reloadRuleset(handler, dirs, "SIGHUP", true)
+				reload, readConfig = nil, false
+			case <-reload:
+				reloadRuleset(handler, dirs, reason, readConfig)
+				reload, readConfig = nil, false
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				switch {
+				case listChanged([]string{configFile}, e.Name):
+					reason, readConfig = "config changed", true
+				case listChanged(ruleset.Files(), e.Name):
+					if !readConfig {
+						reason = "domain list changed"
+					}
+				default:
+					continue
+				}
+				// each change restarts the wait so a file written in
+				// several steps is only read once it is complete
+				reload = time.After(reloadDelay)
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				log.WithError(err).Error("config watch failed")
+			}
+		}
+	}()
+}
+
+// reloadRuleset load the ruleset again, reading the config file first when it
+// may have changed, then update the watched directories to match the domain
+// lists now in use
+func reloadRuleset(handler *l7proxify.TLSHandler, dirs *watchedDirs, reason string, readConfig bool) {
+
+	ruleset := handler.Ruleset
+
+	log.WithField("reason", reason).Info("reloading ruleset")
+
+	if readConfig {
+		err := viper.ReadInConfig()
+		if err != nil {
+			log.WithError(err).Error("failed to load config, keeping existing ruleset")
+			return
+		}
+	}
+
+	err := ruleset.LoadConfig(rulesetConfig())
+	if err != nil {
+		log.WithError(err).Error("invalid ruleset, keeping existing ruleset")
+		return
+	}
+
+	warnDestinations(handler)
+
+	dirs.watch(append([]string{viper.ConfigFileUsed()}, ruleset.Files()...))
+}
+
+// warnDestinations log the rules with destination conditions which the dial
+// mode doesn't enforce
+func warnDestinations(handler *l7proxify.TLSHandler) {
+	for _, warning := range handler.DestinationWarnings() {
+		log.Warn(warning)
+	}
+}
+
+// watchedDirs the directories being watched for the config file and domain
+// lists, a nil watcher watches nothing
+type watchedDirs struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+}
+
+// watch watch the directories holding the files and stop watching any which
+// no longer hold one, as config files and domain lists are often replaced
+// rather than written in place the file itself isn't watched.
+func (wd *watchedDirs) watch(files []string) {
+	if wd.watcher == nil {
+		return
+	}
+
+	want := map[string]bool{}
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(path)
+		want[dir] = true
+		if wd.dirs[dir] {
+			continue
+		}
+		err = wd.watcher.Add(dir)
+		if err != nil {
+			log.WithError(err).WithField("path", file).Error("failed to watch file")
+			continue
+		}
+		wd.dirs[dir] = true
+	}
+
+	for dir := range wd.dirs {
+		if want[dir] {
+			continue
+		}
+		err := wd.watcher.Remove(dir)
+		if err != nil {
+			log.WithError(err).WithField("path", dir).Warn("failed to stop watching directory")
+		}
+		delete(wd.dirs, dir)
+	}
+}
+
+// listChanged check if the changed file is one of the files, used for the
+// domain lists and the config file
+func listChanged(files []string, name string) bool {
+	changed, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err == nil && path == changed {
+			return true
+		}
+	}
+
+	return false
+}
+
 func main() {
 	if err := cmdRoot.Execute(); err != nil {
 		fmt.Println(err)
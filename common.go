@@ -4,7 +4,10 @@ package l7proxify
 // Use of this source code is governed by a BSD-style
 // license which can be found in the LICENSE file.
 
-import "io"
+import (
+	"fmt"
+	"io"
+)
 
 // TLS record types.
 type recordType uint8
@@ -20,8 +23,42 @@ const (
 	versionTLS10 = 0x0301
 	versionTLS11 = 0x0302
 	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
 )
 
+// versionName the name of a protocol version used in logs and configuration.
+func versionName(vers uint16) string {
+	switch vers {
+	case versionSSL30:
+		return "SSLv3"
+	case versionTLS10:
+		return "1.0"
+	case versionTLS11:
+		return "1.1"
+	case versionTLS12:
+		return "1.2"
+	case versionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", vers)
+}
+
+// parseVersion the version for a name returned by versionName
+func parseVersion(name string) (uint16, bool) {
+	for _, vers := range []uint16{versionSSL30, versionTLS10, versionTLS11, versionTLS12, versionTLS13} {
+		if versionName(vers) == name {
+			return vers, true
+		}
+	}
+	return 0, false
+}
+
+// isGREASE check for the reserved values clients send to make sure servers
+// tolerate unknown versions, cipher suites and extensions, see RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
 const (
 	recordTypeChangeCipherSpec recordType = 20
 	recordTypeAlert            recordType = 21
@@ -55,10 +92,25 @@ const (
 	extensionALPN                uint16 = 16
 	extensionSCT                 uint16 = 18 // https://tools.ietf.org/html/rfc6962#section-6
 	extensionSessionTicket       uint16 = 35
+	extensionPreSharedKey        uint16 = 41
+	extensionEarlyData           uint16 = 42
+	extensionSupportedVersions   uint16 = 43
+	extensionCookie              uint16 = 44
+	extensionPSKModes            uint16 = 45
+	extensionKeyShare            uint16 = 51
 	extensionNextProtoNeg        uint16 = 13172 // not IANA assigned
 	extensionRenegotiationInfo   uint16 = 0xff01
 )
 
+// helloRetryRequestRandom is the random value of a ServerHello which is
+// actually a TLS 1.3 HelloRetryRequest. See RFC 8446, Section 4.1.3.
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
 // TLS signaling cipher suite values
 const (
 	scsvRenegotiation uint16 = 0x00ff
@@ -68,6 +120,18 @@ const (
 // http://www.iana.org/assignments/tls-parameters/tls-parameters.xml#tls-parameters-8
 type CurveID uint16
 
+// keyShare is a TLS 1.3 Key Share. See RFC 8446, Section 4.2.8.
+type keyShare struct {
+	group CurveID
+	data  []byte
+}
+
+// pskIdentity is a TLS 1.3 PSK Identity. See RFC 8446, Section 4.2.11.
+type pskIdentity struct {
+	label               []byte
+	obfuscatedTicketAge uint32
+}
+
 // TLS CertificateStatusType (RFC 3546)
 const (
 	statusTypeOCSP uint8 = 1
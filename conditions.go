@@ -0,0 +1,332 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// MatchRequest the attributes of a connection which rules are matched against
+type MatchRequest struct {
+	// ServerName the SNI hostname from the clientHello
+	ServerName string
+	// ClientIP the address of the client
+	ClientIP net.IP
+	// DestIP and DestPort the original destination of the connection, these
+	// are only known when the connection was redirected to the proxy
+	DestIP   net.IP
+	DestPort int
+	// ALPN the application protocols offered by the client
+	ALPN []string
+	// TLSVersion the highest version offered by the client
+	TLSVersion uint16
+	// CipherSuites the cipher suites offered by the client
+	CipherSuites []uint16
+}
+
+// clientGroup a named list of client networks which rules can refer to
+type clientGroup struct {
+	name     string
+	networks []*net.IPNet
+}
+
+func (g *clientGroup) contains(ip net.IP) bool {
+	return containsIP(g.networks, ip)
+}
+
+// loadGroups load the client groups supplied by configuration, for example
+//
+//	[groups.build-agents]
+//	sources = ["10.1.0.0/16"]
+func loadGroups(groups map[string]interface{}) (map[string]*clientGroup, error) {
+
+	loaded := map[string]*clientGroup{}
+
+	for k, v := range groups {
+		var attrs struct {
+			Sources []string
+		}
+
+		if err := mapstructure.Decode(v, &attrs); err != nil {
+			return nil, err
+		}
+
+		networks, err := parseNetworks(attrs.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("Group %s has invalid sources: %s", k, err)
+		}
+
+		loaded[k] = &clientGroup{name: k, networks: networks}
+	}
+
+	return loaded, nil
+}
+
+// parseNetworks parse a list of CIDRs, a plain address is treated as a single
+// host network.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildClient compile the client conditions of the rule, the groups must exist
+// in the supplied configuration.
+func (r *Rule) buildClient(groups map[string]*clientGroup) (err error) {
+
+	r.sources, err = parseNetworks(r.Sources)
+	if err != nil {
+		return fmt.Errorf("Rule %s has invalid sources: %s", r.Name, err)
+	}
+
+	r.groups = nil
+
+	for _, name := range r.Groups {
+		g, ok := groups[name]
+		if !ok {
+			return fmt.Errorf("Rule %s refers to an unknown group: %s", r.Name, name)
+		}
+		r.groups = append(r.groups, g)
+	}
+
+	return nil
+}
+
+// matchClient check the client is in the sources or groups of the rule, a rule
+// without either matches any client. The name of the group which matched is
+// returned.
+func (r *Rule) matchClient(ip net.IP) (string, bool) {
+	if len(r.sources) == 0 && len(r.groups) == 0 {
+		return "", true
+	}
+
+	if containsIP(r.sources, ip) {
+		return "", true
+	}
+
+	for _, g := range r.groups {
+		if g.contains(ip) {
+			return g.name, true
+		}
+	}
+
+	return "", false
+}
+
+// clientGroups the names of all the groups containing the client
+func clientGroups(groups map[string]*clientGroup, ip net.IP) []string {
+	var names []string
+	for name, g := range groups {
+		if g.contains(ip) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildDestination compile the destination conditions of the rule
+func (r *Rule) buildDestination() (err error) {
+
+	r.destinations, err = parseNetworks(r.Destinations)
+	if err != nil {
+		return fmt.Errorf("Rule %s has invalid destinations: %s", r.Name, err)
+	}
+
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("Rule %s has an invalid port: %d", r.Name, port)
+		}
+	}
+
+	return nil
+}
+
+// matchDestination check the original destination is in the destinations and
+// ports of the rule, a rule without either matches any destination.
+func (r *Rule) matchDestination(ip net.IP, port int) bool {
+	if len(r.destinations) != 0 && !containsIP(r.destinations, ip) {
+		return false
+	}
+
+	if len(r.Ports) == 0 {
+		return true
+	}
+
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildTLS compile the TLS conditions of the rule
+func (r *Rule) buildTLS() error {
+
+	r.minVersion, r.maxVersion = 0, 0
+
+	if r.MinTLSVersion != "" {
+		vers, ok := parseVersion(r.MinTLSVersion)
+		if !ok {
+			return fmt.Errorf("Rule %s has an invalid min_tls_version: %s", r.Name, r.MinTLSVersion)
+		}
+		r.minVersion = vers
+	}
+
+	if r.MaxTLSVersion != "" {
+		vers, ok := parseVersion(r.MaxTLSVersion)
+		if !ok {
+			return fmt.Errorf("Rule %s has an invalid max_tls_version: %s", r.Name, r.MaxTLSVersion)
+		}
+		r.maxVersion = vers
+	}
+
+	var err error
+
+	r.denyCiphers, err = r.cipherSuites(r.DenyCiphers)
+	if err != nil {
+		return err
+	}
+
+	r.offersCiphers, err = r.cipherSuites(r.OffersCiphers)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// cipherSuites parse the names of cipher suites used in a rule condition
+func (r *Rule) cipherSuites(names []string) (map[uint16]bool, error) {
+	ids := map[uint16]bool{}
+
+	for _, name := range names {
+		id, ok := parseCipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("Rule %s has an invalid cipher suite: %s", r.Name, name)
+		}
+		ids[id] = true
+	}
+
+	return ids, nil
+}
+
+// matchTLS check the client hello meets the TLS conditions of the rule, the
+// client must offer one of the ALPN protocols, support the minimum version and
+// offer none of the denied cipher suites. The maximum version and offered
+// cipher suites select legacy clients, for use on deny rules.
+func (r *Rule) matchTLS(req *MatchRequest) bool {
+	if len(r.ALPN) != 0 && !containsAny(r.ALPN, req.ALPN) {
+		return false
+	}
+
+	if req.TLSVersion < r.minVersion {
+		return false
+	}
+
+	if r.maxVersion != 0 && req.TLSVersion > r.maxVersion {
+		return false
+	}
+
+	if len(r.offersCiphers) != 0 && !offersAny(r.offersCiphers, req.CipherSuites) {
+		return false
+	}
+
+	for _, id := range req.CipherSuites {
+		if r.denyCiphers[id] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// offersAny check if any of the cipher suites offered is in the set
+func offersAny(set map[uint16]bool, offered []uint16) bool {
+	for _, id := range offered {
+		if set[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		for _, l := range list {
+			if v == l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCipherSuite accept either the standard name of a cipher suite known to
+// crypto/tls, such as TLS_RSA_WITH_RC4_128_SHA, or the hex identifier of any
+// other suite, such as 0x0005.
+func parseCipherSuite(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range suites {
+			if cs.Name == name {
+				return cs.ID, true
+			}
+		}
+	}
+
+	if !strings.HasPrefix(name, "0x") {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(name[2:], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint16(id), true
+}
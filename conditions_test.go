@@ -0,0 +1,192 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetworks(t *testing.T) {
+
+	networks, err := parseNetworks([]string{"10.1.0.0/16", "192.168.1.5", "2001:db8::1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.0/16", networks[0].String())
+	assert.Equal(t, "192.168.1.5/32", networks[1].String())
+	assert.Equal(t, "2001:db8::1/128", networks[2].String())
+
+	_, err = parseNetworks([]string{"10.1.0.0/33"})
+	assert.NotNil(t, err)
+
+	_, err = parseNetworks([]string{"build-agents"})
+	assert.EqualError(t, err, "invalid address build-agents")
+}
+
+func TestMatchClient(t *testing.T) {
+
+	rs := &Ruleset{}
+	err := rs.LoadConfig(RulesetConfig{
+		Groups: vals{
+			"build-agents": vals{"sources": []string{"10.1.0.0/16"}},
+			"admins":       vals{"sources": []string{"192.168.10.5"}},
+		},
+		Rules: vals{
+			"001": vals{"exact": "registry.npmjs.org", "action": "allow", "groups": []string{"build-agents"}},
+			"002": vals{"suffix": "example.com", "action": "allow", "groups": []string{"admins"}, "sources": []string{"172.16.0.0/12"}},
+			"003": vals{"match": ".*", "action": "deny"},
+		},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		host   string
+		client string
+		name   string
+		group  string
+	}{
+		{host: "registry.npmjs.org", client: "10.1.2.3", name: "001", group: "build-agents"},
+		{host: "registry.npmjs.org", client: "10.2.2.3", name: "003"},
+		{host: "www.example.com", client: "192.168.10.5", name: "002", group: "admins"},
+		{host: "www.example.com", client: "172.16.4.4", name: "002"},
+		{host: "www.example.com", client: "192.168.10.6", name: "003"},
+	}
+
+	for _, tt := range matchtests {
+		rm := rs.Match(&MatchRequest{ServerName: tt.host, ClientIP: net.ParseIP(tt.client)})
+		assert.NotNil(t, rm, tt.client)
+		assert.Equal(t, tt.name, rm.Rule.Name, tt.client)
+		assert.Equal(t, tt.group, rm.Group, tt.client)
+	}
+
+	// without a client only rules for all clients match
+	assert.Equal(t, "003", rs.MatchRule("registry.npmjs.org").Rule.Name)
+}
+
+func TestMatchClientUnknownGroup(t *testing.T) {
+
+	rs := &Ruleset{}
+	err := rs.LoadConfig(RulesetConfig{
+		Rules: vals{
+			"001": vals{"exact": "github.com", "action": "allow", "groups": []string{"build-agents"}},
+		},
+	})
+	assert.EqualError(t, err, "Rule 001 refers to an unknown group: build-agents")
+}
+
+func TestMatchDestination(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "destinations": []string{"169.254.169.254"}},
+		"002": vals{"suffix": "internal.corp", "action": "allow", "ports": []int{8443}},
+		"003": vals{"match": ".*", "action": "deny"},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		host string
+		dest string
+		port int
+		name string
+	}{
+		{host: "metadata.internal.corp", dest: "169.254.169.254", port: 8443, name: "001"},
+		{host: "git.internal.corp", dest: "10.0.0.1", port: 8443, name: "002"},
+		{host: "git.internal.corp", dest: "10.0.0.1", port: 443, name: "003"},
+	}
+
+	for _, tt := range matchtests {
+		rm := rs.Match(&MatchRequest{ServerName: tt.host, DestIP: net.ParseIP(tt.dest), DestPort: tt.port})
+		assert.NotNil(t, rm, tt.host)
+		assert.Equal(t, tt.name, rm.Rule.Name, tt.host)
+	}
+
+	// without the original destination the conditions can't be checked
+	assert.Equal(t, "003", rs.MatchRule("git.internal.corp").Rule.Name)
+
+	_, err = NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "ports": []int{0}},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid port: 0")
+}
+
+func TestMatchTLS(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "allow", "alpn": []string{"h2", "http/1.1"}, "min_tls_version": "1.2", "deny_ciphers": []string{"TLS_RSA_WITH_RC4_128_SHA", "0x000a"}},
+		"002": vals{"match": ".*", "action": "deny"},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		req  *MatchRequest
+		name string
+	}{
+		{req: &MatchRequest{ALPN: []string{"h2"}, TLSVersion: versionTLS13, CipherSuites: []uint16{0x1301}}, name: "001"},
+		{req: &MatchRequest{ALPN: []string{"imap"}, TLSVersion: versionTLS13, CipherSuites: []uint16{0x1301}}, name: "002"},
+		{req: &MatchRequest{TLSVersion: versionTLS13, CipherSuites: []uint16{0x1301}}, name: "002"},
+		{req: &MatchRequest{ALPN: []string{"http/1.1"}, TLSVersion: versionTLS10, CipherSuites: []uint16{0xc02f}}, name: "002"},
+		{req: &MatchRequest{ALPN: []string{"http/1.1"}, TLSVersion: versionTLS12, CipherSuites: []uint16{0xc02f, 0x0005}}, name: "002"},
+		{req: &MatchRequest{ALPN: []string{"http/1.1"}, TLSVersion: versionTLS12, CipherSuites: []uint16{0xc02f, 0x000a}}, name: "002"},
+		{req: &MatchRequest{ALPN: []string{"http/1.1"}, TLSVersion: versionTLS12, CipherSuites: []uint16{0xc02f}}, name: "001"},
+	}
+
+	for i, tt := range matchtests {
+		tt.req.ServerName = "github.com"
+		rm := rs.Match(tt.req)
+		assert.NotNil(t, rm, i)
+		assert.Equal(t, tt.name, rm.Rule.Name, i)
+	}
+
+	_, err = NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "allow", "min_tls_version": "1.4"},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid min_tls_version: 1.4")
+
+	_, err = NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "max_tls_version": "1.4"},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid max_tls_version: 1.4")
+
+	_, err = NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "allow", "deny_ciphers": []string{"TLS_NOT_A_CIPHER"}},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid cipher suite: TLS_NOT_A_CIPHER")
+
+	_, err = NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "offers_ciphers": []string{"TLS_NOT_A_CIPHER"}},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid cipher suite: TLS_NOT_A_CIPHER")
+}
+
+func TestMatchLegacyTLS(t *testing.T) {
+
+	// deny legacy clients outright, allowing everything else
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "max_tls_version": "1.1"},
+		"002": vals{"match": ".*", "action": "deny", "offers_ciphers": []string{"TLS_RSA_WITH_RC4_128_SHA", "0x000a"}},
+		"003": vals{"match": ".*", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		req  *MatchRequest
+		name string
+	}{
+		{req: &MatchRequest{TLSVersion: versionTLS10, CipherSuites: []uint16{0xc02f}}, name: "001"},
+		{req: &MatchRequest{TLSVersion: versionTLS11, CipherSuites: []uint16{0xc02f}}, name: "001"},
+		{req: &MatchRequest{TLSVersion: versionTLS12, CipherSuites: []uint16{0xc02f, 0x0005}}, name: "002"},
+		{req: &MatchRequest{TLSVersion: versionTLS12, CipherSuites: []uint16{0x000a}}, name: "002"},
+		{req: &MatchRequest{TLSVersion: versionTLS12, CipherSuites: []uint16{0xc02f}}, name: "003"},
+		{req: &MatchRequest{TLSVersion: versionTLS13, CipherSuites: []uint16{0x1301}}, name: "003"},
+	}
+
+	for i, tt := range matchtests {
+		tt.req.ServerName = "github.com"
+		rm := rs.Match(tt.req)
+		assert.NotNil(t, rm, i)
+		assert.Equal(t, tt.name, rm.Rule.Name, i)
+	}
+}
@@ -9,38 +9,65 @@ import (
 	"github.com/apex/log"
 )
 
-// Conn used within l7proxify
+// Conn used within l7proxify, it wraps any net.Conn
 type Conn struct {
-	*net.TCPConn
+	net.Conn
 
 	Log log.Interface
 
+	// rawInput holds the records read while peeking so they can be forwarded
+	// unchanged by WritePeak
 	rawInput bytes.Buffer
+	// hand holds the handshake data read while peeking with the record headers
+	// stripped, this may span multiple records
+	hand bytes.Buffer
 }
 
 // NewConn new l7proxify connection
-func NewConn(conn *net.TCPConn) *Conn {
+func NewConn(conn net.Conn) *Conn {
 	return &Conn{
-		TCPConn: conn,
-		Log:     log.WithField("conn", conn.RemoteAddr().String()),
+		Conn: conn,
+		Log:  log.WithField("conn", conn.RemoteAddr().String()),
 	}
 }
 
+// rawHandshakeMsg a handshake message we don't need to parse, like
+// ServerKeyExchange or ServerHelloDone, which is returned so the caller can
+// step over it.
+type rawHandshakeMsg struct {
+	typ uint8
+	raw []byte
+}
+
+// peakHandshake iterate over the handshake messages in the peeked records,
+// each call returns the next message in turn, reading as many records as needed
+// to reassemble it. A single record can hold several messages, for example
+// ServerHello, Certificate and ServerHelloDone, these are returned from the
+// buffer without reading from the connection.
 func (c *Conn) peakHandshake() (interface{}, error) {
-	for c.rawInput.Len() < 4 {
+	for c.hand.Len() < 4 {
 		if err := c.peakRecord(recordTypeHandshake); err != nil {
 			return nil, err
 		}
 	}
 
-	// build a slice minus the record header
-	data := c.rawInput.Bytes()[recordHeaderLen:]
+	data := c.hand.Bytes()
 
 	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
 	if n > maxHandshake {
 		return nil, fmt.Errorf("tls: oversized handshake with length %d", n)
 	}
 
+	for c.hand.Len() < 4+n {
+		if err := c.peakRecord(recordTypeHandshake); err != nil {
+			return nil, err
+		}
+	}
+
+	data = c.hand.Next(4 + n)
+
+	data = append([]byte(nil), data...)
+
 	var m handshakeMessage
 	switch data[0] {
 	case typeClientHello:
@@ -52,11 +79,9 @@ func (c *Conn) peakHandshake() (interface{}, error) {
 	case typeFinished:
 		m = new(finishedMsg)
 	default:
-		return nil, fmt.Errorf("unexpected message type %d", data[0])
+		return &rawHandshakeMsg{typ: data[0], raw: data}, nil
 	}
 
-	data = append([]byte(nil), data...)
-
 	if !m.unmarshal(data) {
 		return nil, fmt.Errorf("unexpected message type %d", data[0])
 	}
@@ -117,16 +142,37 @@ func (c *Conn) peakRecord(want recordType) error {
 	switch typ {
 	default:
 		return fmt.Errorf("tls: unexpected record type")
+	case recordTypeChangeCipherSpec:
+		// TLS 1.3 middlebox compatibility mode sends a dummy change cipher spec
+		// within the handshake, this is kept so it is forwarded but isn't part
+		// of the handshake data
+		if want != recordTypeHandshake {
+			return fmt.Errorf("tls: wanted record type %d got %d", want, typ)
+		}
+		c.rawInput.Write(record)
 	case recordTypeHandshake:
 		if typ != want {
 			return fmt.Errorf("tls: wanted record type %d got %d", want, typ)
 		}
 		c.rawInput.Write(record)
+		c.hand.Write(record)
 	}
 
 	return nil
 }
 
+// sendAlert write a fatal alert record to the connection, this is sent in the
+// clear as no keys have been negotiated.
+func (c *Conn) sendAlert(vers uint16, a alert) error {
+
+	c.Log.WithField("alert", a.String()).Debug("send alert")
+
+	record := []byte{byte(recordTypeAlert), byte(vers >> 8), byte(vers), 0, 2, alertLevelError, byte(a)}
+
+	_, err := c.Write(record)
+	return err
+}
+
 // WritePeak write the current peak buffer to the supplied writer
 // and reset the peack buffers.
 func (c *Conn) WritePeak(w io.Writer) (int, error) {
@@ -134,6 +180,10 @@ func (c *Conn) WritePeak(w io.Writer) (int, error) {
 	data := c.rawInput.Bytes()
 	c.rawInput.Reset()
 
+	// any handshake data not yet returned by peakHandshake is forwarded with
+	// the raw records so there is no need to keep it
+	c.hand.Reset()
+
 	c.Log.WithField("len", len(data)).Debug("write peak")
 
 	return w.Write(data)
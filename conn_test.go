@@ -0,0 +1,178 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpPipe returns both ends of a loopback TCP connection.
+func tcpPipe(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c1, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c1, c2
+}
+
+// records split the handshake data into records of at most size bytes.
+func records(data []byte, size int) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+		buf.Write([]byte{byte(recordTypeHandshake), 0x03, 0x01, byte(n >> 8), byte(n)})
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	return buf.Bytes()
+}
+
+func testClientHello() *clientHelloMsg {
+	return &clientHelloMsg{
+		vers:               versionTLS12,
+		random:             make([]byte, 32),
+		sessionID:          make([]byte, 32),
+		cipherSuites:       []uint16{0xc02f, 0xc030},
+		compressionMethods: []uint8{0},
+		serverName:         "github.com",
+		ticketSupported:    true,
+		// pad the hello out so it must span several records
+		sessionTicket: bytes.Repeat([]byte{0x01}, 3000),
+	}
+}
+
+func TestPeakHandshakeFragmented(t *testing.T) {
+
+	var sizetests = []int{16384, 1024, 100, 1}
+
+	for _, size := range sizetests {
+		in, out := tcpPipe(t)
+
+		data := records(testClientHello().marshal(), size)
+
+		go func() {
+			in.Write(data)
+			in.Close()
+		}()
+
+		c := NewConn(out)
+
+		msg, err := c.peakHandshake()
+		assert.Nil(t, err, "record size %d", size)
+
+		clientHello, ok := msg.(*clientHelloMsg)
+		assert.True(t, ok, "record size %d", size)
+		assert.Equal(t, "github.com", clientHello.serverName)
+
+		var buf bytes.Buffer
+		_, err = c.WritePeak(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, data, buf.Bytes(), "record size %d", size)
+
+		c.Close()
+	}
+}
+
+func TestPeakHandshakeCoalesced(t *testing.T) {
+
+	in, out := tcpPipe(t)
+
+	serverHello := &serverHelloMsg{
+		vers:              versionTLS12,
+		random:            make([]byte, 32),
+		sessionId:         make([]byte, 32),
+		cipherSuite:       0xc02f,
+		compressionMethod: 0,
+	}
+
+	certificate := &certificateMsg{
+		certificates: [][]byte{bytes.Repeat([]byte{0x02}, 100)},
+	}
+
+	serverHelloDone := []byte{typeServerHelloDone, 0, 0, 0}
+
+	var hand []byte
+	hand = append(hand, serverHello.marshal()...)
+	hand = append(hand, certificate.marshal()...)
+	hand = append(hand, serverHelloDone...)
+
+	data := records(hand, 16384)
+
+	go func() {
+		in.Write(data)
+		in.Close()
+	}()
+
+	c := NewConn(out)
+	defer c.Close()
+
+	msg, err := c.peakHandshake()
+	assert.Nil(t, err)
+	_, ok := msg.(*serverHelloMsg)
+	assert.True(t, ok, "serverHello expected")
+
+	msg, err = c.peakHandshake()
+	assert.Nil(t, err)
+	certs, ok := msg.(*certificateMsg)
+	assert.True(t, ok, "certificate expected")
+	assert.Equal(t, certificate.certificates, certs.certificates)
+
+	msg, err = c.peakHandshake()
+	assert.Nil(t, err)
+	done, ok := msg.(*rawHandshakeMsg)
+	assert.True(t, ok, "serverHelloDone expected")
+	assert.Equal(t, typeServerHelloDone, done.typ)
+
+	var buf bytes.Buffer
+	_, err = c.WritePeak(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf.Bytes())
+}
+
+func TestSendAlert(t *testing.T) {
+
+	in, out := tcpPipe(t)
+	defer in.Close()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- tls.Client(in, &tls.Config{ServerName: "github.com"}).Handshake()
+	}()
+
+	c := NewConn(out)
+	defer c.Close()
+
+	msg, err := c.peakHandshake()
+	assert.Nil(t, err)
+
+	clientHello := msg.(*clientHelloMsg)
+
+	err = c.sendAlert(clientHello.vers, alertUnrecognizedName)
+	assert.Nil(t, err)
+
+	err = <-errc
+	assert.EqualError(t, err, "remote error: tls: unrecognized name")
+}
@@ -0,0 +1,203 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// domain list formats supported by rules with a list attribute
+const (
+	// listFormatDomains one domain per line, a leading . or *. matches
+	// subdomains only
+	listFormatDomains = "domains"
+	// listFormatHosts a hosts file, every hostname after the address is used
+	listFormatHosts = "hosts"
+	// listFormatAdblock adblock filters of the form ||example.com^ which match
+	// the domain and its subdomains
+	listFormatAdblock = "adblock"
+)
+
+// listEntry how a domain from a list is matched
+type listEntry int
+
+const (
+	// entryExact matches the name only
+	entryExact listEntry = iota
+	// entrySubdomains matches subdomains of the name only
+	entrySubdomains
+	// entryDomain matches the name and its subdomains
+	entryDomain
+)
+
+// hostsIgnored names found in most hosts files which aren't part of the list
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// domainListMatcher matches a list of domains loaded from a file, entries are
+// either exact names or suffixes which match subdomains.
+type domainListMatcher struct {
+	path   string
+	exact  map[string]bool
+	suffix map[string]bool
+}
+
+func (m *domainListMatcher) matchHost(host string) bool {
+	if m.exact[host] {
+		return true
+	}
+
+	for i := strings.IndexByte(host, '.'); i != -1; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if m.suffix[host] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadDomainList read the list in the given format, entries which can't be
+// used are skipped and counted rather than failing the whole list.
+func loadDomainList(path, format string) (*domainListMatcher, error) {
+
+	var parse func(line string) (domains []string, entry listEntry, ok bool)
+
+	switch format {
+	case "", listFormatDomains:
+		parse = parseDomainsLine
+	case listFormatHosts:
+		parse = parseHostsLine
+	case listFormatAdblock:
+		parse = parseAdblockLine
+	default:
+		return nil, fmt.Errorf("invalid list format: %s", format)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &domainListMatcher{
+		path:   path,
+		exact:  map[string]bool{},
+		suffix: map[string]bool{},
+	}
+
+	var loaded, skipped int
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// blank lines and comments
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		domains, entry, ok := parse(line)
+		if !ok {
+			skipped++
+			continue
+		}
+
+		for _, domain := range domains {
+			host, err := parseHostname(domain)
+			if err != nil || hostsIgnored[host] {
+				skipped++
+				continue
+			}
+
+			if entry != entrySubdomains {
+				m.exact[host] = true
+			}
+			if entry != entryExact {
+				m.suffix[host] = true
+			}
+			loaded++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"path":    path,
+		"format":  format,
+		"loaded":  loaded,
+		"skipped": skipped,
+	}).Info("loaded domain list")
+
+	return m, nil
+}
+
+func parseDomainsLine(line string) ([]string, listEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 1 {
+		return nil, entryExact, false
+	}
+
+	domain := fields[0]
+
+	switch {
+	case strings.HasPrefix(domain, "*."):
+		return []string{domain[2:]}, entrySubdomains, true
+	case strings.HasPrefix(domain, "."):
+		return []string{domain[1:]}, entrySubdomains, true
+	}
+
+	return []string{domain}, entryExact, true
+}
+
+func parseHostsLine(line string) ([]string, listEntry, bool) {
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, entryExact, false
+	}
+
+	return fields[1:], entryExact, true
+}
+
+func parseAdblockLine(line string) ([]string, listEntry, bool) {
+	// only plain domain anchors are supported, exceptions, paths and options
+	// change the meaning of the filter
+	if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+		return nil, entryExact, false
+	}
+
+	domain := line[2 : len(line)-1]
+
+	if domain == "" || strings.ContainsAny(domain, "/*$^|") {
+		return nil, entryExact, false
+	}
+
+	// ||example.com^ matches the domain and all subdomains
+	return []string{domain}, entryDomain, true
+}
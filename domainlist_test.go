@@ -0,0 +1,75 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDomainList(t *testing.T) {
+
+	var listtests = []struct {
+		format  string
+		content string
+		match   []string
+		nomatch []string
+	}{
+		{
+			format:  "domains",
+			content: "# vendor feed\ngithub.com\n.amazonaws.com\n*.example.com\nnot a domain\n",
+			match:   []string{"github.com", "s3.amazonaws.com", "www.example.com"},
+			nomatch: []string{"api.github.com", "amazonaws.com", "example.com"},
+		},
+		{
+			format:  "hosts",
+			content: "127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # trackers\nbogus.example.com\n",
+			match:   []string{"ads.example.com", "tracker.example.com"},
+			nomatch: []string{"localhost", "www.ads.example.com", "bogus.example.com"},
+		},
+		{
+			format:  "adblock",
+			content: "[Adblock Plus 2.0]\n! comment\n||ads.example.com^\n||tracker.example.com^$third-party\n@@||good.example.com^\n",
+			match:   []string{"ads.example.com", "www.ads.example.com"},
+			nomatch: []string{"tracker.example.com", "good.example.com"},
+		},
+	}
+
+	for _, tt := range listtests {
+		path := filepath.Join(t.TempDir(), "list.txt")
+
+		err := os.WriteFile(path, []byte(tt.content), 0600)
+		assert.Nil(t, err)
+
+		rs, err := NewRuleset(vals{
+			"001": vals{"list": path, "format": tt.format, "action": "deny"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{path}, rs.Files())
+
+		for _, host := range tt.match {
+			assert.NotNil(t, rs.MatchRule(host), "%s: %s", tt.format, host)
+		}
+		for _, host := range tt.nomatch {
+			assert.Nil(t, rs.MatchRule(host), "%s: %s", tt.format, host)
+		}
+	}
+}
+
+func TestLoadDomainListInvalid(t *testing.T) {
+
+	_, err := NewRuleset(vals{
+		"001": vals{"list": "does-not-exist.txt", "action": "deny"},
+	})
+	assert.NotNil(t, err)
+
+	_, err = NewRuleset(vals{
+		"001": vals{"list": "does-not-exist.txt", "format": "csv", "action": "deny"},
+	})
+	assert.EqualError(t, err, "Rule has an invalid list: invalid list format: csv")
+}
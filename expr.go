@@ -0,0 +1,108 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/google/cel-go/cel"
+)
+
+// exprCostLimit bounds the work done evaluating a single expression, CEL has no
+// loops so this only guards against very large comprehensions
+const exprCostLimit = 10000
+
+// exprEnv the CEL environment rule expressions are compiled in, the variables
+// describe the connection being matched:
+//
+//	sni            string            the normalised SNI hostname
+//	alpn           list(string)      application protocols offered by the client
+//	tls_version    string            highest version offered, for example "1.3"
+//	client_ip      string            address of the client
+//	client_groups  list(string)      client groups containing the client
+//	dest_ip        string            original destination address, or ""
+//	dest_port      int               original destination port, or 0
+//	now            google.protobuf.Timestamp  time of the match
+var exprEnv, exprEnvErr = cel.NewEnv(
+	cel.Variable("sni", cel.StringType),
+	cel.Variable("alpn", cel.ListType(cel.StringType)),
+	cel.Variable("tls_version", cel.StringType),
+	cel.Variable("client_ip", cel.StringType),
+	cel.Variable("client_groups", cel.ListType(cel.StringType)),
+	cel.Variable("dest_ip", cel.StringType),
+	cel.Variable("dest_port", cel.IntType),
+	cel.Variable("now", cel.TimestampType),
+)
+
+// compileExpr compile and type check the expression, it must return a bool
+func compileExpr(expr string) (cel.Program, error) {
+	if exprEnvErr != nil {
+		return nil, exprEnvErr
+	}
+
+	ast, iss := exprEnv.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("expression must return a bool not %s", ast.OutputType())
+	}
+
+	return exprEnv.Program(ast, cel.CostLimit(exprCostLimit))
+}
+
+// exprActivation the variables for an expression, these are built once for each
+// match and shared by all the rules with expressions
+func exprActivation(req *MatchRequest, host string, groups []string, now time.Time) map[string]interface{} {
+	vars := map[string]interface{}{
+		"sni":           host,
+		"alpn":          req.ALPN,
+		"tls_version":   "",
+		"client_ip":     "",
+		"client_groups": groups,
+		"dest_ip":       "",
+		"dest_port":     req.DestPort,
+		"now":           now,
+	}
+
+	if req.ALPN == nil {
+		vars["alpn"] = []string{}
+	}
+	if groups == nil {
+		vars["client_groups"] = []string{}
+	}
+	if req.TLSVersion != 0 {
+		vars["tls_version"] = versionName(req.TLSVersion)
+	}
+	if req.ClientIP != nil {
+		vars["client_ip"] = req.ClientIP.String()
+	}
+	if req.DestIP != nil {
+		vars["dest_ip"] = req.DestIP.String()
+	}
+
+	return vars
+}
+
+// matchExpr evaluate the expression of the rule, a rule without one always
+// matches. An expression which fails to evaluate doesn't match.
+func (r *Rule) matchExpr(vars map[string]interface{}) bool {
+	if r.program == nil {
+		return true
+	}
+
+	out, _, err := r.program.Eval(vars)
+	if err != nil {
+		log.WithError(err).WithField("name", r.Name).Warn("Rule expression failed")
+		return false
+	}
+
+	matched, ok := out.Value().(bool)
+
+	return ok && matched
+}
@@ -0,0 +1,89 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchExpr(t *testing.T) {
+
+	rs := &Ruleset{}
+	err := rs.LoadConfig(RulesetConfig{
+		Groups: vals{
+			"build-agents": vals{"sources": []string{"10.1.0.0/16"}},
+		},
+		Rules: vals{
+			"001": vals{"expr": `sni.endsWith(".corp") && "build-agents" in client_groups`, "action": "allow"},
+			"002": vals{"suffix": "example.com", "expr": `"h2" in alpn && tls_version == "1.3" && dest_port == 443`, "action": "allow"},
+			"003": vals{"expr": `dest_ip == "169.254.169.254" || client_ip.startsWith("192.168.")`, "action": "deny"},
+			"004": vals{"match": ".*", "action": "deny"},
+		},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		req  *MatchRequest
+		name string
+	}{
+		{req: &MatchRequest{ServerName: "git.corp", ClientIP: net.ParseIP("10.1.2.3")}, name: "001"},
+		{req: &MatchRequest{ServerName: "git.corp", ClientIP: net.ParseIP("10.2.2.3")}, name: "004"},
+		{req: &MatchRequest{ServerName: "www.example.com", ALPN: []string{"h2"}, TLSVersion: versionTLS13, DestPort: 443}, name: "002"},
+		{req: &MatchRequest{ServerName: "www.example.com", ALPN: []string{"h2"}, TLSVersion: versionTLS12, DestPort: 443}, name: "004"},
+		{req: &MatchRequest{ServerName: "www.example.com", ClientIP: net.ParseIP("192.168.1.1")}, name: "003"},
+		{req: &MatchRequest{ServerName: "metadata", DestIP: net.ParseIP("169.254.169.254")}, name: "003"},
+	}
+
+	for i, tt := range matchtests {
+		rm := rs.Match(tt.req)
+		assert.NotNil(t, rm, i)
+		assert.Equal(t, tt.name, rm.Rule.Name, i)
+	}
+}
+
+func TestMatchExprTime(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "github.com", "expr": `now.getFullYear("UTC") > 2000`, "action": "allow"},
+		"002": vals{"exact": "gitlab.com", "expr": `now.getFullYear("UTC") < 2000`, "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, rs.MatchRule("github.com"))
+	assert.Nil(t, rs.MatchRule("gitlab.com"))
+}
+
+func TestCompileExpr(t *testing.T) {
+
+	var compiletests = []struct {
+		expr string
+		err  string
+	}{
+		{expr: `sni == "github.com"`},
+		{expr: `sni`, err: "expression must return a bool"},
+		{expr: `sni ==`, err: "Syntax error"},
+		{expr: `hostname == "github.com"`, err: "undeclared reference to 'hostname'"},
+		{expr: `dest_port == "443"`, err: "found no matching overload"},
+	}
+
+	for _, tt := range compiletests {
+		_, err := compileExpr(tt.expr)
+		if tt.err == "" {
+			assert.Nil(t, err, tt.expr)
+			continue
+		}
+		if assert.NotNil(t, err, tt.expr) {
+			assert.Contains(t, err.Error(), tt.err)
+		}
+	}
+
+	_, err := NewRuleset(vals{
+		"001": vals{"expr": `sni`, "action": "allow"},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid expr: expression must return a bool not string")
+}
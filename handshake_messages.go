@@ -29,6 +29,13 @@ type clientHelloMsg struct {
 	signatureAndHashes  []signatureAndHash
 	secureRenegotiation bool
 	alpnProtocols       []string
+	supportedVersions   []uint16
+	cookie              []byte
+	keyShares           []keyShare
+	earlyData           bool
+	pskModes            []uint8
+	pskIdentities       []pskIdentity
+	pskBinders          [][]byte
 }
 
 func (m *clientHelloMsg) equal(i interface{}) bool {
@@ -53,7 +60,14 @@ func (m *clientHelloMsg) equal(i interface{}) bool {
 		bytes.Equal(m.sessionTicket, m1.sessionTicket) &&
 		eqSignatureAndHashes(m.signatureAndHashes, m1.signatureAndHashes) &&
 		m.secureRenegotiation == m1.secureRenegotiation &&
-		eqStrings(m.alpnProtocols, m1.alpnProtocols)
+		eqStrings(m.alpnProtocols, m1.alpnProtocols) &&
+		eqUint16s(m.supportedVersions, m1.supportedVersions) &&
+		bytes.Equal(m.cookie, m1.cookie) &&
+		eqKeyShares(m.keyShares, m1.keyShares) &&
+		m.earlyData == m1.earlyData &&
+		bytes.Equal(m.pskModes, m1.pskModes) &&
+		eqPSKIdentities(m.pskIdentities, m1.pskIdentities) &&
+		eqByteSlices(m.pskBinders, m1.pskBinders)
 }
 
 func (m *clientHelloMsg) marshal() []byte {
@@ -109,6 +123,38 @@ func (m *clientHelloMsg) marshal() []byte {
 	if m.scts {
 		numExtensions++
 	}
+	if len(m.supportedVersions) > 0 {
+		extensionsLength += 1 + 2*len(m.supportedVersions)
+		numExtensions++
+	}
+	if len(m.cookie) > 0 {
+		extensionsLength += 2 + len(m.cookie)
+		numExtensions++
+	}
+	if len(m.keyShares) > 0 {
+		extensionsLength += 2
+		for _, ks := range m.keyShares {
+			extensionsLength += 4 + len(ks.data)
+		}
+		numExtensions++
+	}
+	if m.earlyData {
+		numExtensions++
+	}
+	if len(m.pskModes) > 0 {
+		extensionsLength += 1 + len(m.pskModes)
+		numExtensions++
+	}
+	if len(m.pskIdentities) > 0 {
+		extensionsLength += 2 + 2
+		for _, psk := range m.pskIdentities {
+			extensionsLength += 2 + len(psk.label) + 4
+		}
+		for _, binder := range m.pskBinders {
+			extensionsLength += 1 + len(binder)
+		}
+		numExtensions++
+	}
 	if numExtensions > 0 {
 		extensionsLength += 4 * numExtensions
 		length += 2 + extensionsLength
@@ -288,6 +334,111 @@ func (m *clientHelloMsg) marshal() []byte {
 		// zero uint16 for the zero-length extension_data
 		z = z[4:]
 	}
+	if len(m.supportedVersions) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.1
+		z[0] = byte(extensionSupportedVersions >> 8)
+		z[1] = byte(extensionSupportedVersions)
+		l := 1 + 2*len(m.supportedVersions)
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(l - 1)
+		z = z[5:]
+		for _, vers := range m.supportedVersions {
+			z[0] = byte(vers >> 8)
+			z[1] = byte(vers)
+			z = z[2:]
+		}
+	}
+	if len(m.cookie) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.2
+		z[0] = byte(extensionCookie >> 8)
+		z[1] = byte(extensionCookie)
+		l := 2 + len(m.cookie)
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(len(m.cookie) >> 8)
+		z[5] = byte(len(m.cookie))
+		copy(z[6:], m.cookie)
+		z = z[l+4:]
+	}
+	if len(m.keyShares) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.8
+		z[0] = byte(extensionKeyShare >> 8)
+		z[1] = byte(extensionKeyShare)
+		l := 0
+		for _, ks := range m.keyShares {
+			l += 4 + len(ks.data)
+		}
+		z[2] = byte((l + 2) >> 8)
+		z[3] = byte(l + 2)
+		z[4] = byte(l >> 8)
+		z[5] = byte(l)
+		z = z[6:]
+		for _, ks := range m.keyShares {
+			z[0] = byte(ks.group >> 8)
+			z[1] = byte(ks.group)
+			z[2] = byte(len(ks.data) >> 8)
+			z[3] = byte(len(ks.data))
+			copy(z[4:], ks.data)
+			z = z[4+len(ks.data):]
+		}
+	}
+	if m.earlyData {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.10
+		z[0] = byte(extensionEarlyData >> 8)
+		z[1] = byte(extensionEarlyData)
+		z = z[4:]
+	}
+	if len(m.pskModes) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.9
+		z[0] = byte(extensionPSKModes >> 8)
+		z[1] = byte(extensionPSKModes)
+		l := 1 + len(m.pskModes)
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(len(m.pskModes))
+		copy(z[5:], m.pskModes)
+		z = z[4+l:]
+	}
+	if len(m.pskIdentities) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.11
+		// this extension must be the last one in the ClientHello
+		z[0] = byte(extensionPreSharedKey >> 8)
+		z[1] = byte(extensionPreSharedKey)
+		identitiesLen := 0
+		for _, psk := range m.pskIdentities {
+			identitiesLen += 2 + len(psk.label) + 4
+		}
+		bindersLen := 0
+		for _, binder := range m.pskBinders {
+			bindersLen += 1 + len(binder)
+		}
+		l := 2 + identitiesLen + 2 + bindersLen
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(identitiesLen >> 8)
+		z[5] = byte(identitiesLen)
+		z = z[6:]
+		for _, psk := range m.pskIdentities {
+			z[0] = byte(len(psk.label) >> 8)
+			z[1] = byte(len(psk.label))
+			copy(z[2:], psk.label)
+			z = z[2+len(psk.label):]
+			z[0] = byte(psk.obfuscatedTicketAge >> 24)
+			z[1] = byte(psk.obfuscatedTicketAge >> 16)
+			z[2] = byte(psk.obfuscatedTicketAge >> 8)
+			z[3] = byte(psk.obfuscatedTicketAge)
+			z = z[4:]
+		}
+		z[0] = byte(bindersLen >> 8)
+		z[1] = byte(bindersLen)
+		z = z[2:]
+		for _, binder := range m.pskBinders {
+			z[0] = byte(len(binder))
+			copy(z[1:], binder)
+			z = z[1+len(binder):]
+		}
+	}
 
 	m.raw = x
 
@@ -344,6 +495,13 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 	m.signatureAndHashes = nil
 	m.alpnProtocols = nil
 	m.scts = false
+	m.supportedVersions = nil
+	m.cookie = nil
+	m.keyShares = nil
+	m.earlyData = false
+	m.pskModes = nil
+	m.pskIdentities = nil
+	m.pskBinders = nil
 
 	if len(data) == 0 {
 		// ClientHello is optionally followed by extension data
@@ -480,6 +638,117 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 			if length != 0 {
 				return false
 			}
+		case extensionSupportedVersions:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.1
+			if length < 1 {
+				return false
+			}
+			l := int(data[0])
+			if l%2 == 1 || length != l+1 {
+				return false
+			}
+			d := data[1:length]
+			for len(d) > 0 {
+				m.supportedVersions = append(m.supportedVersions, uint16(d[0])<<8|uint16(d[1]))
+				d = d[2:]
+			}
+		case extensionCookie:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.2
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if l == 0 || length != l+2 {
+				return false
+			}
+			m.cookie = data[2:length]
+		case extensionKeyShare:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.8
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if length != l+2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) > 0 {
+				if len(d) < 4 {
+					return false
+				}
+				ks := keyShare{group: CurveID(d[0])<<8 | CurveID(d[1])}
+				dataLen := int(d[2])<<8 | int(d[3])
+				d = d[4:]
+				if dataLen == 0 || len(d) < dataLen {
+					return false
+				}
+				ks.data = d[:dataLen]
+				d = d[dataLen:]
+				m.keyShares = append(m.keyShares, ks)
+			}
+		case extensionEarlyData:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.10
+			if length != 0 {
+				return false
+			}
+			m.earlyData = true
+		case extensionPSKModes:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.9
+			if length < 1 {
+				return false
+			}
+			l := int(data[0])
+			if length != l+1 {
+				return false
+			}
+			m.pskModes = data[1:length]
+		case extensionPreSharedKey:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.11
+			// this extension must be the last one in the ClientHello
+			if len(data) != length {
+				return false
+			}
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if length < l+2 {
+				return false
+			}
+			d := data[2 : 2+l]
+			for len(d) > 0 {
+				if len(d) < 2 {
+					return false
+				}
+				labelLen := int(d[0])<<8 | int(d[1])
+				d = d[2:]
+				if labelLen == 0 || len(d) < labelLen+4 {
+					return false
+				}
+				psk := pskIdentity{label: d[:labelLen]}
+				d = d[labelLen:]
+				psk.obfuscatedTicketAge = uint32(d[0])<<24 | uint32(d[1])<<16 | uint32(d[2])<<8 | uint32(d[3])
+				d = d[4:]
+				m.pskIdentities = append(m.pskIdentities, psk)
+			}
+			d = data[2+l : length]
+			if len(d) < 2 {
+				return false
+			}
+			l = int(d[0])<<8 | int(d[1])
+			d = d[2:]
+			if len(d) != l {
+				return false
+			}
+			for len(d) > 0 {
+				binderLen := int(d[0])
+				d = d[1:]
+				if binderLen == 0 || len(d) < binderLen {
+					return false
+				}
+				m.pskBinders = append(m.pskBinders, d[:binderLen])
+				d = d[binderLen:]
+			}
 		}
 		data = data[length:]
 	}
@@ -501,6 +770,12 @@ type serverHelloMsg struct {
 	ticketSupported     bool
 	secureRenegotiation bool
 	alpnProtocol        string
+	supportedVersion    uint16
+	serverShare         keyShare
+	selectedIdentityOK  bool
+	selectedIdentity    uint16
+	cookie              []byte
+	selectedGroup       CurveID
 }
 
 func (m *serverHelloMsg) equal(i interface{}) bool {
@@ -529,7 +804,46 @@ func (m *serverHelloMsg) equal(i interface{}) bool {
 		m.ocspStapling == m1.ocspStapling &&
 		m.ticketSupported == m1.ticketSupported &&
 		m.secureRenegotiation == m1.secureRenegotiation &&
-		m.alpnProtocol == m1.alpnProtocol
+		m.alpnProtocol == m1.alpnProtocol &&
+		m.supportedVersion == m1.supportedVersion &&
+		m.serverShare.group == m1.serverShare.group &&
+		bytes.Equal(m.serverShare.data, m1.serverShare.data) &&
+		m.selectedIdentityOK == m1.selectedIdentityOK &&
+		m.selectedIdentity == m1.selectedIdentity &&
+		bytes.Equal(m.cookie, m1.cookie) &&
+		m.selectedGroup == m1.selectedGroup
+}
+
+// maxVersion the highest version offered by the client, TLS 1.3 clients keep
+// the legacy version at TLS 1.2 and list the real ones using the
+// supported_versions extension. GREASE values are ignored.
+func (m *clientHelloMsg) maxVersion() uint16 {
+	max := m.vers
+	for _, v := range m.supportedVersions {
+		if isGREASE(v) {
+			continue
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// negotiatedVersion the version selected by the server, TLS 1.3 servers keep
+// the legacy version at TLS 1.2 and select the real one using the
+// supported_versions extension.
+func (m *serverHelloMsg) negotiatedVersion() uint16 {
+	if m.supportedVersion != 0 {
+		return m.supportedVersion
+	}
+	return m.vers
+}
+
+// isHelloRetryRequest a TLS 1.3 HelloRetryRequest is sent as a ServerHello
+// with a special random value.
+func (m *serverHelloMsg) isHelloRetryRequest() bool {
+	return bytes.Equal(m.random, helloRetryRequestRandom)
 }
 
 func (m *serverHelloMsg) marshal() []byte {
@@ -575,6 +889,26 @@ func (m *serverHelloMsg) marshal() []byte {
 		extensionsLength += 2 + sctLen
 		numExtensions++
 	}
+	if m.supportedVersion != 0 {
+		extensionsLength += 2
+		numExtensions++
+	}
+	if m.serverShare.group != 0 {
+		extensionsLength += 4 + len(m.serverShare.data)
+		numExtensions++
+	}
+	if m.selectedIdentityOK {
+		extensionsLength += 2
+		numExtensions++
+	}
+	if len(m.cookie) > 0 {
+		extensionsLength += 2 + len(m.cookie)
+		numExtensions++
+	}
+	if m.selectedGroup != 0 {
+		extensionsLength += 2
+		numExtensions++
+	}
 
 	if numExtensions > 0 {
 		extensionsLength += 4 * numExtensions
@@ -667,6 +1001,59 @@ func (m *serverHelloMsg) marshal() []byte {
 			z = z[len(sct)+2:]
 		}
 	}
+	if m.supportedVersion != 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.1
+		z[0] = byte(extensionSupportedVersions >> 8)
+		z[1] = byte(extensionSupportedVersions)
+		z[3] = 2
+		z[4] = byte(m.supportedVersion >> 8)
+		z[5] = byte(m.supportedVersion)
+		z = z[6:]
+	}
+	if m.serverShare.group != 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.8
+		z[0] = byte(extensionKeyShare >> 8)
+		z[1] = byte(extensionKeyShare)
+		l := 4 + len(m.serverShare.data)
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(m.serverShare.group >> 8)
+		z[5] = byte(m.serverShare.group)
+		z[6] = byte(len(m.serverShare.data) >> 8)
+		z[7] = byte(len(m.serverShare.data))
+		copy(z[8:], m.serverShare.data)
+		z = z[4+l:]
+	}
+	if m.selectedIdentityOK {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.11
+		z[0] = byte(extensionPreSharedKey >> 8)
+		z[1] = byte(extensionPreSharedKey)
+		z[3] = 2
+		z[4] = byte(m.selectedIdentity >> 8)
+		z[5] = byte(m.selectedIdentity)
+		z = z[6:]
+	}
+	if len(m.cookie) > 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.2
+		z[0] = byte(extensionCookie >> 8)
+		z[1] = byte(extensionCookie)
+		l := 2 + len(m.cookie)
+		z[2] = byte(l >> 8)
+		z[3] = byte(l)
+		z[4] = byte(len(m.cookie) >> 8)
+		z[5] = byte(len(m.cookie))
+		copy(z[6:], m.cookie)
+		z = z[4+l:]
+	}
+	if m.selectedGroup != 0 {
+		// https://tools.ietf.org/html/rfc8446#section-4.2.8
+		z[0] = byte(extensionKeyShare >> 8)
+		z[1] = byte(extensionKeyShare)
+		z[3] = 2
+		z[4] = byte(m.selectedGroup >> 8)
+		z[5] = byte(m.selectedGroup)
+		z = z[6:]
+	}
 
 	m.raw = x
 
@@ -699,6 +1086,12 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 	m.scts = nil
 	m.ticketSupported = false
 	m.alpnProtocol = ""
+	m.supportedVersion = 0
+	m.serverShare = keyShare{}
+	m.selectedIdentityOK = false
+	m.selectedIdentity = 0
+	m.cookie = nil
+	m.selectedGroup = 0
 
 	if len(data) == 0 {
 		// ServerHello is optionally followed by extension data
@@ -785,7 +1178,7 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			if l == 0 {
-				continue
+				break
 			}
 
 			m.scts = make([][]byte, 0, 3)
@@ -801,6 +1194,45 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				m.scts = append(m.scts, d[:sctLen])
 				d = d[sctLen:]
 			}
+		case extensionSupportedVersions:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.1
+			if length != 2 {
+				return false
+			}
+			m.supportedVersion = uint16(data[0])<<8 | uint16(data[1])
+		case extensionKeyShare:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.8
+			// a HelloRetryRequest only carries the selected group
+			if length == 2 {
+				m.selectedGroup = CurveID(data[0])<<8 | CurveID(data[1])
+				break
+			}
+			if length < 4 {
+				return false
+			}
+			m.serverShare.group = CurveID(data[0])<<8 | CurveID(data[1])
+			l := int(data[2])<<8 | int(data[3])
+			if l == 0 || length != l+4 {
+				return false
+			}
+			m.serverShare.data = data[4:length]
+		case extensionPreSharedKey:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.11
+			if length != 2 {
+				return false
+			}
+			m.selectedIdentityOK = true
+			m.selectedIdentity = uint16(data[0])<<8 | uint16(data[1])
+		case extensionCookie:
+			// https://tools.ietf.org/html/rfc8446#section-4.2.2
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if l == 0 || length != l+2 {
+				return false
+			}
+			m.cookie = data[2:length]
 		}
 		data = data[length:]
 	}
@@ -992,3 +1424,27 @@ func eqSignatureAndHashes(x, y []signatureAndHash) bool {
 	}
 	return true
 }
+
+func eqKeyShares(x, y []keyShare) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i].group != y[i].group || !bytes.Equal(x[i].data, y[i].data) {
+			return false
+		}
+	}
+	return true
+}
+
+func eqPSKIdentities(x, y []pskIdentity) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !bytes.Equal(x[i].label, y[i].label) || x[i].obfuscatedTicketAge != y[i].obfuscatedTicketAge {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientHelloTLS13(t *testing.T) {
+
+	m := testClientHello()
+	m.sessionTicket = nil
+	m.supportedVersions = []uint16{versionTLS13, versionTLS12}
+	m.cookie = []byte{1, 2, 3}
+	m.keyShares = []keyShare{{group: 29, data: bytes.Repeat([]byte{0x04}, 32)}}
+	m.earlyData = true
+	m.pskModes = []uint8{1}
+	m.pskIdentities = []pskIdentity{{label: []byte("ticket"), obfuscatedTicketAge: 1234}}
+	m.pskBinders = [][]byte{bytes.Repeat([]byte{0x05}, 32)}
+
+	m1 := new(clientHelloMsg)
+	assert.True(t, m1.unmarshal(m.marshal()))
+	assert.True(t, m.equal(m1))
+}
+
+func TestServerHelloTLS13(t *testing.T) {
+
+	var hellotests = []*serverHelloMsg{
+		{
+			vers:               versionTLS12,
+			random:             make([]byte, 32),
+			sessionId:          make([]byte, 32),
+			cipherSuite:        0x1301,
+			supportedVersion:   versionTLS13,
+			serverShare:        keyShare{group: 29, data: bytes.Repeat([]byte{0x04}, 32)},
+			selectedIdentityOK: true,
+			selectedIdentity:   0,
+		},
+		{
+			vers:             versionTLS12,
+			random:           helloRetryRequestRandom,
+			sessionId:        make([]byte, 32),
+			cipherSuite:      0x1301,
+			supportedVersion: versionTLS13,
+			cookie:           []byte{1, 2, 3},
+			selectedGroup:    23,
+		},
+	}
+
+	for _, m := range hellotests {
+		m1 := new(serverHelloMsg)
+		assert.True(t, m1.unmarshal(m.marshal()))
+		assert.True(t, m.equal(m1))
+		assert.Equal(t, uint16(versionTLS13), m1.negotiatedVersion())
+		assert.Equal(t, m.selectedGroup != 0, m1.isHelloRetryRequest())
+	}
+}
+
+func TestParseCryptoTLSClientHello(t *testing.T) {
+
+	in, out := tcpPipe(t)
+	defer in.Close()
+
+	go tls.Client(in, &tls.Config{ServerName: "github.com", NextProtos: []string{"h2"}}).Handshake()
+
+	c := NewConn(out)
+	defer c.Close()
+
+	msg, err := c.peakHandshake()
+	assert.Nil(t, err)
+
+	clientHello, ok := msg.(*clientHelloMsg)
+	assert.True(t, ok, "clientHello expected")
+	assert.Equal(t, "github.com", clientHello.serverName)
+	assert.Equal(t, []string{"h2"}, clientHello.alpnProtocols)
+	assert.Contains(t, clientHello.supportedVersions, uint16(versionTLS13))
+	assert.NotEmpty(t, clientHello.keyShares)
+	assert.Equal(t, uint16(versionTLS13), clientHello.maxVersion())
+}
+
+func TestClientHelloMaxVersion(t *testing.T) {
+
+	var versiontests = []struct {
+		m        *clientHelloMsg
+		expected uint16
+	}{
+		{m: &clientHelloMsg{vers: versionTLS10}, expected: versionTLS10},
+		{m: &clientHelloMsg{vers: versionTLS12, supportedVersions: []uint16{0x7a7a, versionTLS13, versionTLS12}}, expected: versionTLS13},
+		{m: &clientHelloMsg{vers: versionTLS12, supportedVersions: []uint16{0xfafa, versionTLS12}}, expected: versionTLS12},
+	}
+
+	for _, tt := range versiontests {
+		assert.Equal(t, tt.expected, tt.m.maxVersion())
+	}
+}
@@ -0,0 +1,170 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostMatcher matches a normalised hostname
+type hostMatcher interface {
+	matchHost(host string) bool
+}
+
+// normaliseHost lowercase the hostname, remove any trailing dot and convert
+// internationalised names to punycode so they can be compared.
+func normaliseHost(host string) (string, error) {
+	ascii, err := idna.ToASCII(strings.TrimSuffix(strings.ToLower(host), "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %s", host, err)
+	}
+
+	return ascii, nil
+}
+
+// parseHostname normalise a hostname from the configuration, rejecting
+// wildcards, empty labels and characters which can't appear in a hostname as
+// a rule using it would never match.
+func parseHostname(host string) (string, error) {
+	ascii, err := normaliseHost(host)
+	if err != nil {
+		return "", err
+	}
+
+	if ascii == "" {
+		return "", fmt.Errorf("empty hostname")
+	}
+
+	for _, label := range strings.Split(ascii, ".") {
+		if !validLabel(label) {
+			return "", fmt.Errorf("invalid hostname %q: bad label %q", host, label)
+		}
+	}
+
+	return ascii, nil
+}
+
+// validLabel check a normalised label is 1 to 63 letters, digits, hyphens or
+// underscores, underscores aren't valid in hostnames but are common in DNS.
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 {
+		return false
+	}
+
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// regexpMatcher matches the hostname using a regular expression
+type regexpMatcher struct {
+	cregx *regexp.Regexp
+}
+
+func (m *regexpMatcher) matchHost(host string) bool {
+	return m.cregx.MatchString(host)
+}
+
+// exactMatcher matches a single hostname
+type exactMatcher struct {
+	host string
+}
+
+func (m *exactMatcher) matchHost(host string) bool {
+	return host == m.host
+}
+
+// suffixMatcher matches a domain on a label boundary, so example.com matches
+// example.com and www.example.com but not badexample.com. A leading dot, as in
+// .example.com, only matches subdomains.
+type suffixMatcher struct {
+	domain     string
+	subdomains bool
+}
+
+func newSuffixMatcher(suffix string) (*suffixMatcher, error) {
+	subdomains := strings.HasPrefix(suffix, ".")
+
+	domain, err := parseHostname(strings.TrimPrefix(suffix, "."))
+	if err != nil {
+		return nil, err
+	}
+
+	return &suffixMatcher{domain: domain, subdomains: subdomains}, nil
+}
+
+func (m *suffixMatcher) matchHost(host string) bool {
+	if host == m.domain {
+		return !m.subdomains
+	}
+	return strings.HasSuffix(host, "."+m.domain)
+}
+
+// wildcardMatcher matches a pattern where a * label matches any single label,
+// so *.s3.amazonaws.com matches bucket.s3.amazonaws.com but not
+// s3.amazonaws.com or a.bucket.s3.amazonaws.com.
+type wildcardMatcher struct {
+	labels []string
+}
+
+func newWildcardMatcher(pattern string) (*wildcardMatcher, error) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(pattern), "."), ".")
+
+	for i, label := range labels {
+		if label == "*" {
+			continue
+		}
+		if strings.Contains(label, "*") {
+			return nil, fmt.Errorf("wildcard must be a whole label: %s", pattern)
+		}
+		ascii, err := normaliseHost(label)
+		if err != nil || !validLabel(ascii) {
+			return nil, fmt.Errorf("invalid wildcard: %s", pattern)
+		}
+		labels[i] = ascii
+	}
+
+	return &wildcardMatcher{labels: labels}, nil
+}
+
+func (m *wildcardMatcher) matchHost(host string) bool {
+	labels := strings.Split(host, ".")
+
+	if len(labels) != len(m.labels) {
+		return false
+	}
+
+	for i, label := range m.labels {
+		if label == "*" {
+			if labels[i] == "" {
+				return false
+			}
+			continue
+		}
+		if labels[i] != label {
+			return false
+		}
+	}
+
+	return true
+}
+
+// anyMatcher matches every hostname, used by rules which only have an
+// expression
+type anyMatcher struct{}
+
+func (m *anyMatcher) matchHost(host string) bool {
+	return true
+}
@@ -0,0 +1,85 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseHost(t *testing.T) {
+
+	var normtests = []struct {
+		host     string
+		expected string
+	}{
+		{host: "GitHub.com", expected: "github.com"},
+		{host: "github.com.", expected: "github.com"},
+		{host: "bücher.example", expected: "xn--bcher-kva.example"},
+		{host: "xn--bcher-kva.example", expected: "xn--bcher-kva.example"},
+	}
+
+	for _, tt := range normtests {
+		host, err := normaliseHost(tt.host)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, host)
+	}
+}
+
+func TestRuleMatchers(t *testing.T) {
+
+	var matchtests = []struct {
+		rule  vals
+		host  string
+		match bool
+	}{
+		{rule: vals{"exact": "github.com"}, host: "github.com", match: true},
+		{rule: vals{"exact": "github.com"}, host: "GITHUB.COM.", match: true},
+		{rule: vals{"exact": "github.com"}, host: "api.github.com", match: false},
+		{rule: vals{"suffix": ".amazonaws.com"}, host: "s3.amazonaws.com", match: true},
+		{rule: vals{"suffix": ".amazonaws.com"}, host: "amazonaws.com", match: false},
+		{rule: vals{"suffix": ".amazonaws.com"}, host: "evilamazonaws.com", match: false},
+		{rule: vals{"suffix": "amazonaws.com"}, host: "amazonaws.com", match: true},
+		{rule: vals{"suffix": "amazonaws.com"}, host: "a.b.amazonaws.com", match: true},
+		{rule: vals{"wildcard": "*.s3.amazonaws.com"}, host: "bucket.s3.amazonaws.com", match: true},
+		{rule: vals{"wildcard": "*.s3.amazonaws.com"}, host: "s3.amazonaws.com", match: false},
+		{rule: vals{"wildcard": "*.s3.amazonaws.com"}, host: "a.bucket.s3.amazonaws.com", match: false},
+		{rule: vals{"wildcard": "api.*.example.com"}, host: "api.eu.example.com", match: true},
+		{rule: vals{"exact": "bücher.example"}, host: "xn--bcher-kva.example", match: true},
+		{rule: vals{"match": "amazonaws.com$"}, host: "evilamazonaws.com", match: true},
+	}
+
+	for _, tt := range matchtests {
+		tt.rule["action"] = "allow"
+
+		rs, err := NewRuleset(vals{"001": tt.rule})
+		assert.Nil(t, err)
+
+		rm := rs.MatchRule(tt.host)
+		assert.Equal(t, tt.match, rm != nil, "rule %v host %s", tt.rule, tt.host)
+	}
+}
+
+func TestRuleMatchersInvalid(t *testing.T) {
+
+	var invalidtests = []vals{
+		{"action": "allow"},
+		{"action": "allow", "exact": "github.com", "suffix": ".github.com"},
+		{"action": "allow", "wildcard": "api*.example.com"},
+		{"action": "allow", "suffix": "."},
+		{"action": "allow", "suffix": "*.example.com"},
+		{"action": "allow", "suffix": ".a..example.com"},
+		{"action": "allow", "exact": "*.example.com"},
+		{"action": "allow", "exact": "a..b"},
+		{"action": "allow", "exact": "www.example.com/path"},
+		{"action": "allow", "wildcard": "*..example.com"},
+	}
+
+	for _, rule := range invalidtests {
+		_, err := NewRuleset(vals{"001": rule})
+		assert.NotNil(t, err, "rule %v", rule)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	soOriginalDst = 80
+	// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+	ip6tSoOriginalDst = 80
+)
+
+// originalDestination retrieve the destination the client was connecting to
+// before the connection was redirected to us by netfilter (iptables REDIRECT
+// or DNAT).
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	level, opt := syscall.SOL_IP, soOriginalDst
+
+	if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+		level, opt = syscall.SOL_IPV6, ip6tSoOriginalDst
+	}
+
+	var (
+		raw     syscall.RawSockaddrAny
+		sockErr error
+	)
+
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofSockaddrAny)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			uintptr(level), uintptr(opt),
+			uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST failed: %s", sockErr)
+	}
+
+	switch raw.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&raw))
+		return &net.TCPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(ntohs(sa.Port)),
+		}, nil
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&raw))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.TCPAddr{
+			IP:   ip,
+			Port: int(ntohs(sa.Port)),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported address family %d", raw.Addr.Family)
+}
+
+// ntohs the port in the raw sockaddr is stored in network byte order.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return binary.BigEndian.Uint16(b[:])
+}
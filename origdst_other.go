@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"net"
+)
+
+// originalDestination is only supported on linux where netfilter records the
+// original destination of redirected connections.
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("original destination lookup not supported on this platform")
+}
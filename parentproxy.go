@@ -0,0 +1,151 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// parentProxyTimeout limits how long connecting through a parent proxy,
+// including the proxy handshake, can take
+const parentProxyTimeout = 30 * time.Second
+
+// ParseParentProxy parse the URL of a parent proxy upstream connections are made
+// through, either http://[user:password@]host:port which uses HTTP CONNECT or
+// socks5://[user:password@]host:port.
+func ParseParentProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid parent proxy scheme: %s", u.Scheme)
+	}
+
+	if err := validateUpstream(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid parent proxy address: %s", err)
+	}
+
+	return u, nil
+}
+
+// dialParentProxy connect to the parent proxy using the dialer and ask it to
+// open a connection to addr. Once the handshake completes the connection is
+// used as if it was to addr.
+func dialParentProxy(ctx context.Context, d Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+
+	if proxy.Scheme == "socks5" {
+		return dialSOCKS5(ctx, d, proxy, addr)
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch proxy.Scheme {
+	case "http":
+		err = httpConnect(conn, proxy, addr)
+	default:
+		err = fmt.Errorf("invalid parent proxy scheme: %s", proxy.Scheme)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// httpConnect open a tunnel to addr using HTTP CONNECT, with basic auth when
+// the proxy URL includes a user
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) error {
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("parent proxy CONNECT to %s failed: %s", addr, res.Status)
+	}
+
+	// the client speaks first in TLS so the proxy has nothing else to send,
+	// anything buffered here would be lost
+	if br.Buffered() != 0 {
+		return errors.New("parent proxy sent data after the CONNECT response")
+	}
+
+	return nil
+}
+
+// dialSOCKS5 open a connection to addr through a SOCKS5 parent proxy, with
+// username and password auth when the proxy URL includes a user
+func dialSOCKS5(ctx context.Context, d Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+
+	var auth *netproxy.Auth
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth = &netproxy.Auth{User: proxy.User.Username(), Password: password}
+	}
+
+	sd, err := netproxy.SOCKS5("tcp", proxy.Host, auth, forwardDialer{d})
+	if err != nil {
+		return nil, err
+	}
+
+	return sd.(netproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// forwardDialer adapts a Dialer to the x/net proxy package, which uses
+// DialContext when it is available
+type forwardDialer struct {
+	Dialer
+}
+
+func (d forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
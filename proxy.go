@@ -6,13 +6,17 @@ package l7proxify
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/apex/log"
 )
@@ -22,6 +26,8 @@ type Session struct {
 	fromBytes, toBytes int64
 	laddr, raddr       net.Addr
 	lconn, rconn       *Conn
+	origAddr           *net.TCPAddr
+	handler            *TLSHandler
 	Log                log.Interface
 
 	certs          []*x509.Certificate
@@ -31,11 +37,13 @@ type Session struct {
 }
 
 // NewSession new proxy session
-func NewSession(lconn *net.TCPConn) *Session {
+func NewSession(lconn net.Conn) *Session {
 	return &Session{
-		laddr: lconn.LocalAddr(),
-		lconn: NewConn(lconn),
-		Log:   log.WithField("sessionID", generateID()),
+		laddr:   lconn.LocalAddr(),
+		raddr:   lconn.RemoteAddr(),
+		lconn:   NewConn(lconn),
+		handler: &TLSHandler{},
+		Log:     log.WithField("sessionID", generateID()),
 	}
 }
 
@@ -57,6 +65,13 @@ func (s *Session) Start() {
 
 	s.Log.Info("Starting session")
 
+	s.origAddr, err = s.originalDestination()
+	if err != nil {
+		s.Log.WithError(err).Debug("original destination lookup failed")
+	} else {
+		s.Log.WithField("origAddr", s.origAddr.String()).Debug("original destination")
+	}
+
 	lmsg, err := s.lconn.peakHandshake()
 	if err != nil {
 		s.Log.WithError(err).Error("read handshake failed")
@@ -75,37 +90,102 @@ func (s *Session) Start() {
 		return
 	}
 
-	rm := MatchRule(clientHello.serverName)
+	req := &MatchRequest{
+		ServerName:   clientHello.serverName,
+		ClientIP:     addrIP(s.raddr),
+		ALPN:         clientHello.alpnProtocols,
+		TLSVersion:   clientHello.maxVersion(),
+		CipherSuites: clientHello.cipherSuites,
+	}
+
+	if s.origAddr != nil {
+		req.DestIP, req.DestPort = s.origAddr.IP, s.origAddr.Port
+	}
+
+	rm := s.handler.ruleset().Match(req)
 
 	if rm == nil {
-		s.Log.WithField("serverName", clientHello.serverName).Error("No matching rule found connection is rejected")
-		return
+		rm = &RuleMatch{Action: ActionReject}
 	}
 
-	s.Log.WithFields(log.Fields{
-		"name":   rm.Rule.Name,
-		"action": rm.Rule.Action,
-	}).Debug("Rule matched")
+	if rm.Rule != nil {
+		s.Log.WithFields(log.Fields{
+			"name":        rm.Rule.Name,
+			"action":      rm.Rule.Action,
+			"description": rm.Rule.Description,
+			"owner":       rm.Rule.Owner,
+			"ticket":      rm.Rule.Ticket,
+		}).Debug("Rule matched")
+	}
+
+	if rm.Group != "" {
+		s.Log = s.Log.WithField("clientGroup", rm.Group)
+	}
+
+	action := rm.Action
+
+	// in monitor mode the decision of the rules is logged but never enforced,
+	// a hostname which isn't valid is still rejected as there is nothing to
+	// dial
+	if action == ActionReject && rm.Reason == "" && s.handler.Monitor {
+		action = ActionMonitor
+	}
 
-	switch rm.Action {
+	decision := s.Log.WithFields(log.Fields{
+		"serverName":    clientHello.serverName,
+		"rule":          rm.ruleName(),
+		"defaultAction": rm.Default,
+	})
+
+	switch action {
 	case ActionReject:
-		s.Log.WithField("serverName", clientHello.serverName).Error("Connection rejected")
+		switch {
+		case rm.Reason != "":
+			decision.WithField("reason", rm.Reason).Error("Connection rejected")
+		case rm.Rule == nil:
+			decision.Error("No matching rule found connection is rejected by default")
+		default:
+			decision.Error("Connection rejected")
+		}
+		s.sendAlert(clientHello, rm.alert())
 		return
+	case ActionMonitor:
+		decision.Warn("Connection would be rejected, monitor only so it is accepted")
 	case ActionAccept:
-		s.Log.WithField("serverName", clientHello.serverName).Debug("Connection accepted")
+		if rm.Default {
+			decision.Info("No matching rule found connection is accepted by default")
+		} else {
+			decision.Debug("Connection accepted")
+		}
+	case ActionRoute:
+		decision.WithFields(log.Fields{
+			"upstreams":  rm.Upstreams,
+			"rewriteSNI": rm.Rule.rewriteSNI,
+		}).Debug("Connection routed")
 	}
 
-	remoteAddr := fmt.Sprintf("%s:%d", clientHello.serverName, 443) // todo not hard coded
-
-	s.Log.WithField("remoteAddr", remoteAddr).Info("opening connection")
+	if s.handler.VerifySNI != SNIVerifyOff {
+		err = s.verifySNI(clientHello.serverName)
+		if err != nil {
+			s.Log = s.Log.WithField("sniVerified", false)
+			if s.handler.VerifySNI == SNIVerifyReject {
+				s.Log.WithError(err).Error("SNI verification failed connection is rejected")
+				s.sendAlert(clientHello, defaultDenyAlert)
+				return
+			}
+			s.Log.WithError(err).Warn("SNI verification failed")
+		} else {
+			s.Log = s.Log.WithField("sniVerified", true)
+		}
+	}
 
-	raddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	remoteAddrs, err := s.upstreamAddrs(clientHello.serverName, rm)
 	if err != nil {
-		s.Log.WithError(err).Error("resolve failed")
+		s.Log.WithError(err).Error("upstream address failed")
 		return
 	}
 
-	c, err := net.DialTCP("tcp", nil, raddr)
+	c, err := s.dialUpstreams(remoteAddrs, s.parentProxy(rm))
 	if err != nil {
 		s.Log.WithError(err).Error("remote connection")
 		return
@@ -125,33 +205,32 @@ func (s *Session) Start() {
 
 	s.Log.WithField("len", n).Debug("clientHello written to server")
 
-	smsg, err := s.rconn.peakHandshake()
+	serverHello, err := s.readServerHello(clientHello)
 	if err != nil {
-		s.Log.WithError(err).Error("read handshake failed")
+		s.Log.WithError(err).Error("read serverHello failed")
 		return
 	}
 
-	serverHello, ok := smsg.(*serverHelloMsg)
+	vers := serverHello.negotiatedVersion()
 
-	if !ok {
-		s.Log.Errorf("serverHello expected")
-		return
-	}
+	s.Log = s.Log.WithField("tlsVersion", versionName(vers))
 
 	s.Log.WithField("sessionId", serverHello.sessionId).Debug("serverHello")
 
-	n, err = s.rconn.WritePeak(s.lconn)
-	if err != nil {
-		s.Log.Errorf("Write failed '%s'\n", err)
-		return
-	}
-
-	s.Log.WithField("len", n).Debug("serverHello written to client")
-
-	// if the session identifiers don't match then we should expect the server to
-	// return a certificate message which we need to validate
-	if !bytes.Equal(clientHello.sessionID, serverHello.sessionId) {
-
+	switch {
+	case vers >= versionTLS13:
+		// everything after the serverHello is encrypted in TLS 1.3
+		if !s.certificateHidden("encrypted") {
+			return
+		}
+	case len(serverHello.sessionId) > 0 && bytes.Equal(clientHello.sessionID, serverHello.sessionId):
+		// the server is resuming the session so won't send a certificate
+		if !s.certificateHidden("resumed") {
+			return
+		}
+	default:
+		// we should expect the server to return a certificate message which we
+		// need to validate, this is often in the same record as the serverHello
 		cmsg, err := s.rconn.peakHandshake()
 		if err != nil {
 			s.Log.WithError(err).Error("read handshake failed")
@@ -164,26 +243,42 @@ func (s *Session) Start() {
 			return
 		}
 
-		err = s.validateCerts(certs.certificates)
+		err = s.validateCerts(clientHello.serverName, certs.certificates)
 
 		if err != nil {
 			s.Log.WithError(err).Errorf("certificate validation failed")
 			return
 		}
+	}
 
-		n, err = s.rconn.WritePeak(s.lconn)
-		if err != nil {
-			s.Log.Errorf("Write failed '%s'\n", err)
-			return
-		}
+	// forward the serverHello and any messages which arrived with it, the
+	// remainder of the handshake is relayed as is
+	n, err = s.rconn.WritePeak(s.lconn)
+	if err != nil {
+		s.Log.Errorf("Write failed '%s'\n", err)
+		return
+	}
 
-		s.Log.WithField("len", n).Debug("server certificates written to client")
+	s.Log.WithField("len", n).Debug("server handshake written to client")
+
+	if !rm.Until.IsZero() {
+		s.Log.WithField("until", rm.Until).Debug("session terminates when the rule schedule closes")
+
+		// measured with the ruleset's clock, which the rule was matched at
+		t := time.AfterFunc(rm.Until.Sub(s.handler.ruleset().now()), func() {
+			s.Log.WithField("name", rm.Rule.Name).Info("Rule schedule closed terminating session")
+			s.lconn.Close()
+			s.rconn.Close()
+		})
+		defer t.Stop()
 	}
 
 	s.wait.Add(2)
 
-	go s.pipe(s.lconn, s.rconn, &s.toBytes)
-	go s.pipe(s.rconn, s.lconn, &s.fromBytes)
+	// the peeked handshake has been forwarded so the underlying connections
+	// can be used directly
+	go s.pipe(s.lconn.Conn, s.rconn.Conn, &s.toBytes)
+	go s.pipe(s.rconn.Conn, s.lconn.Conn, &s.fromBytes)
 
 	s.wait.Wait()
 
@@ -194,6 +289,306 @@ func (s *Session) Start() {
 
 }
 
+// sendAlert tell the client why the connection is being closed rather than
+// just resetting it.
+func (s *Session) sendAlert(clientHello *clientHelloMsg, a alert) {
+	// TLS 1.3 clients also expect the legacy version in the record header
+	err := s.lconn.sendAlert(clientHello.vers, a)
+	if err != nil {
+		s.Log.WithError(err).Error("send alert failed")
+	}
+}
+
+// originalDestination in transparent mode TPROXY preserves the destination as
+// the local address of the accepted socket, otherwise ask netfilter for the
+// destination before it was redirected.
+func (s *Session) originalDestination() (*net.TCPAddr, error) {
+	if s.handler.Transparent {
+		addr, ok := s.laddr.(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected local address type %T", s.laddr)
+		}
+		return addr, nil
+	}
+
+	tcpConn, ok := s.lconn.Conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original destination lookup needs a TCP connection not %T", s.lconn.Conn)
+	}
+
+	return originalDestination(tcpConn)
+}
+
+// selfDestination check if the original destination is the proxy itself, as
+// it is when a client connects straight to the listener rather than being
+// redirected. Dialing it would connect back to the proxy over and over until
+// it runs out of file descriptors.
+func (s *Session) selfDestination() bool {
+	// without TPROXY the local address of a redirected connection is the
+	// listener, so it only matches the original destination when nothing
+	// redirected it
+	if laddr, ok := s.laddr.(*net.TCPAddr); ok && !s.handler.Transparent {
+		if laddr.IP.Equal(s.origAddr.IP) && laddr.Port == s.origAddr.Port {
+			return true
+		}
+	}
+
+	return s.handler.isListenAddr(s.origAddr)
+}
+
+// verifySNI resolve the SNI hostname and check the original destination IP is
+// among the answers, this stops a client presenting an allowed name while
+// connecting to some other address.
+func (s *Session) verifySNI(serverName string) error {
+	if s.origAddr == nil {
+		return fmt.Errorf("original destination is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := s.handler.resolver().LookupIPAddr(ctx, serverName)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.Equal(s.origAddr.IP) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("original destination %s not found in addresses resolved for %s", s.origAddr.IP, serverName)
+}
+
+// dial open the upstream connection using the handler's dialer, with a parent
+// proxy the connection is made through it.
+func (s *Session) dial(remoteAddr string, parent *url.URL) (net.Conn, error) {
+
+	d, err := s.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	if parent != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), parentProxyTimeout)
+		defer cancel()
+
+		return dialParentProxy(ctx, d, parent, remoteAddr)
+	}
+
+	// bounded so a blackholed upstream fails over to the next one quickly
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	return d.DialContext(ctx, "tcp", remoteAddr)
+}
+
+// dialer the handler's dialer, or by default a net.Dialer which when
+// SpoofSource is enabled binds the connection to the client's address so
+// upstream firewalls see the real client.
+func (s *Session) dialer() (Dialer, error) {
+	if s.handler.Dialer != nil {
+		return s.handler.Dialer, nil
+	}
+
+	d := &net.Dialer{}
+
+	if s.handler.SpoofSource {
+		caddr, ok := s.lconn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected client address type %T", s.lconn.RemoteAddr())
+		}
+		d.LocalAddr = &net.TCPAddr{IP: caddr.IP}
+		d.Control = transparentControl
+	}
+
+	return d, nil
+}
+
+// addrIP the IP of a TCP address, or nil for any other type of address
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// upstreamAddrs the addresses to try for the upstream server, route rules
+// supply their own, otherwise it is built using the dial mode
+func (s *Session) upstreamAddrs(serverName string, rm *RuleMatch) ([]string, error) {
+	if len(rm.Upstreams) != 0 {
+		return rm.Upstreams, nil
+	}
+
+	if rm.Rule != nil && rm.Rule.rewriteSNI != "" {
+		port, err := s.upstreamPort()
+		if err != nil {
+			return nil, err
+		}
+		return []string{net.JoinHostPort(rm.Rule.rewriteSNI, strconv.Itoa(port))}, nil
+	}
+
+	addr, err := s.upstreamAddr(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{addr}, nil
+}
+
+// upstreamAddr build the address of the upstream server using the dial mode
+func (s *Session) upstreamAddr(serverName string) (string, error) {
+	if s.handler.DialMode == DialOriginalDestination {
+		if s.origAddr == nil {
+			return "", fmt.Errorf("original destination is not available")
+		}
+		if s.selfDestination() {
+			return "", fmt.Errorf("original destination %s is the proxy's own address", s.origAddr)
+		}
+		return s.origAddr.String(), nil
+	}
+
+	port, err := s.upstreamPort()
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(serverName, strconv.Itoa(port)), nil
+}
+
+// upstreamPort the port of the upstream server using the dial mode, either the
+// configured port or that of the original destination
+func (s *Session) upstreamPort() (int, error) {
+	if s.handler.DialMode == DialSNI {
+		return s.handler.dialPort(), nil
+	}
+
+	if s.origAddr == nil {
+		return 0, fmt.Errorf("original destination is not available")
+	}
+
+	return s.origAddr.Port, nil
+}
+
+// parentProxy the proxy to connect through, the matched rule can override the
+// handler's proxy or bypass it
+func (s *Session) parentProxy(rm *RuleMatch) *url.URL {
+	if rm.Rule != nil && rm.Rule.Proxy != "" {
+		return rm.Rule.proxy
+	}
+	return s.handler.ParentProxy
+}
+
+// dialUpstreams open a connection to the first of the addresses which accepts
+// one, the error from the last attempt is returned if none do
+func (s *Session) dialUpstreams(remoteAddrs []string, parent *url.URL) (net.Conn, error) {
+
+	var err error
+
+	if parent != nil {
+		s.Log = s.Log.WithField("parentProxy", parent.Redacted())
+	}
+
+	for _, remoteAddr := range remoteAddrs {
+		s.Log.WithField("remoteAddr", remoteAddr).Info("opening connection")
+
+		var c net.Conn
+
+		c, err = s.dial(remoteAddr, parent)
+		if err == nil {
+			s.Log = s.Log.WithField("remoteAddr", remoteAddr)
+			return c, nil
+		}
+
+		s.Log.WithError(err).WithField("remoteAddr", remoteAddr).Warn("upstream connection failed")
+	}
+
+	return nil, err
+}
+
+// readServerHello read the serverHello, when the server sends a TLS 1.3
+// HelloRetryRequest it is relayed to the client along with the client's second
+// clientHello before reading the real serverHello.
+func (s *Session) readServerHello(clientHello *clientHelloMsg) (*serverHelloMsg, error) {
+
+	serverHello, err := s.peakServerHello()
+	if err != nil {
+		return nil, err
+	}
+
+	if !serverHello.isHelloRetryRequest() {
+		return serverHello, nil
+	}
+
+	s.Log.WithField("selectedGroup", serverHello.selectedGroup).Debug("helloRetryRequest")
+
+	if _, err = s.rconn.WritePeak(s.lconn); err != nil {
+		return nil, err
+	}
+
+	msg, err := s.lconn.peakHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	retryHello, ok := msg.(*clientHelloMsg)
+	if !ok {
+		return nil, fmt.Errorf("clientHello expected")
+	}
+
+	// the rules were matched using the first clientHello
+	if retryHello.serverName != clientHello.serverName {
+		return nil, fmt.Errorf("serverName changed after helloRetryRequest")
+	}
+
+	if _, err = s.lconn.WritePeak(s.rconn); err != nil {
+		return nil, err
+	}
+
+	serverHello, err = s.peakServerHello()
+	if err != nil {
+		return nil, err
+	}
+
+	if serverHello.isHelloRetryRequest() {
+		return nil, fmt.Errorf("unexpected second helloRetryRequest")
+	}
+
+	return serverHello, nil
+}
+
+func (s *Session) peakServerHello() (*serverHelloMsg, error) {
+	msg, err := s.rconn.peakHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	serverHello, ok := msg.(*serverHelloMsg)
+	if !ok {
+		return nil, fmt.Errorf("serverHello expected")
+	}
+
+	return serverHello, nil
+}
+
+// certificateHidden apply the handler's policy when the server certificate
+// can't be seen, returns false if the connection should be closed.
+func (s *Session) certificateHidden(reason string) bool {
+	if s.handler.HiddenCert == CertPolicyDeny {
+		s.Log.WithField("reason", reason).Error("certificate not visible connection is rejected")
+		return false
+	}
+
+	s.Log.WithField("reason", reason).Debug("certificate not visible")
+
+	return true
+}
+
+// pipe copy from one connection to the other, once the source is done the
+// write side of the destination is closed so the other direction can finish.
+// Connections which can't be half-closed, such as TLS or unix sockets without
+// CloseWrite, are closed outright.
 func (s *Session) pipe(to, from net.Conn, bytesCopied *int64) {
 	var err error
 	defer s.wait.Done()
@@ -201,15 +596,32 @@ func (s *Session) pipe(to, from net.Conn, bytesCopied *int64) {
 	if err != nil {
 		s.Log.WithError(err).Error("pipe failed")
 	}
+
+	if cw, ok := to.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	to.Close()
+}
+
+// closeWriter a connection which supports half-close, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
 }
 
-func (s *Session) validateCerts(certificates [][]byte) error {
+// validateCerts parse and verify the server's certificate chain, the leaf must
+// be valid for the SNI hostname so the server is the one the rules allowed.
+func (s *Session) validateCerts(serverName string, certificates [][]byte) error {
 
 	var (
 		err  error
 		cert *x509.Certificate
 	)
 
+	if len(certificates) == 0 {
+		return fmt.Errorf("server sent no certificates")
+	}
+
 	for _, asn1Data := range certificates {
 
 		cert, err = x509.ParseCertificate(asn1Data)
@@ -228,6 +640,7 @@ func (s *Session) validateCerts(certificates [][]byte) error {
 	}
 
 	opts := x509.VerifyOptions{
+		DNSName:       serverName,
 		Intermediates: x509.NewCertPool(),
 	}
 
@@ -248,17 +661,238 @@ func (s *Session) validateCerts(certificates [][]byte) error {
 	return nil
 }
 
+// DialMode controls how the upstream address is built for a session.
+type DialMode int
+
+const (
+	// DialSNI dial the SNI hostname using the port configured on the handler
+	DialSNI DialMode = iota
+	// DialSNIOriginalPort dial the SNI hostname using the port from the original
+	// destination of the redirected connection
+	DialSNIOriginalPort
+	// DialOriginalDestination dial the original destination of the redirected
+	// connection
+	DialOriginalDestination
+)
+
+// ParseDialMode parse the dial mode names used in configuration.
+func ParseDialMode(mode string) (DialMode, error) {
+	switch mode {
+	case "", "sni":
+		return DialSNI, nil
+	case "sni-origport":
+		return DialSNIOriginalPort, nil
+	case "origdst":
+		return DialOriginalDestination, nil
+	}
+
+	return DialSNI, fmt.Errorf("invalid dial mode: %s", mode)
+}
+
+// SNIVerify controls the check of the SNI hostname against the original
+// destination of the connection.
+type SNIVerify int
+
+const (
+	// SNIVerifyOff skip the check
+	SNIVerifyOff SNIVerify = iota
+	// SNIVerifyLog log a warning when the check fails
+	SNIVerifyLog
+	// SNIVerifyReject reject the connection when the check fails
+	SNIVerifyReject
+)
+
+// ParseSNIVerify parse the SNI verify policy names used in configuration.
+func ParseSNIVerify(policy string) (SNIVerify, error) {
+	switch policy {
+	case "", "off":
+		return SNIVerifyOff, nil
+	case "log":
+		return SNIVerifyLog, nil
+	case "reject":
+		return SNIVerifyReject, nil
+	}
+
+	return SNIVerifyOff, fmt.Errorf("invalid SNI verify policy: %s", policy)
+}
+
+// CertPolicy controls what happens when the server certificate can't be
+// validated because it is encrypted (TLS 1.3) or not sent (session resumption).
+type CertPolicy int
+
+const (
+	// CertPolicyAllow proxy the connection without validating the certificate
+	CertPolicyAllow CertPolicy = iota
+	// CertPolicyDeny close the connection
+	CertPolicyDeny
+)
+
+// ParseCertPolicy parse the certificate policy names used in configuration.
+func ParseCertPolicy(policy string) (CertPolicy, error) {
+	switch policy {
+	case "", "allow":
+		return CertPolicyAllow, nil
+	case "deny":
+		return CertPolicyDeny, nil
+	}
+
+	return CertPolicyAllow, fmt.Errorf("invalid certificate policy: %s", policy)
+}
+
+// resolveTimeout limits how long the SNI verification lookup can take
+const resolveTimeout = 5 * time.Second
+
+// dialTimeout limits how long each direct upstream connection attempt can take
+const dialTimeout = 10 * time.Second
+
+// defaultDialPort used when dialing the SNI hostname without a configured port
+const defaultDialPort = 443
+
 // TLSHandler pulls apart and proxies TLS connections using the client hello
 // SNI field.
 type TLSHandler struct {
+	// Ruleset used to decide the action for each connection, defaults to the
+	// package level ruleset filled by LoadRuleset
+	Ruleset *Ruleset
+	// DialMode how the upstream address is built, defaults to DialSNI
+	DialMode DialMode
+	// DialPort the port used with DialSNI, defaults to 443
+	DialPort int
+	// Transparent connections are accepted from a TPROXY listener so the
+	// original destination is the local address of the socket
+	Transparent bool
+	// SpoofSource bind upstream connections to the client's address, this
+	// requires IP_TRANSPARENT and policy routing for the return traffic. It is
+	// only used by the default dialer.
+	SpoofSource bool
+	// VerifySNI check the SNI hostname resolves to the original destination
+	VerifySNI SNIVerify
+	// HiddenCert what to do when the server certificate can't be seen
+	HiddenCert CertPolicy
+	// Monitor log connections the ruleset would reject but accept them, used
+	// to try out a ruleset against real traffic before enforcing it
+	Monitor bool
+	// Resolver used to look up the SNI hostname, defaults to net.DefaultResolver
+	Resolver *net.Resolver
+	// ParentProxy upstream connections are made through, see ParseParentProxy
+	ParentProxy *url.URL
+	// Dialer opens upstream connections, or the connection to the parent
+	// proxy. Defaults to a net.Dialer.
+	Dialer Dialer
+
+	// listenAddrs the addresses of the listeners serving this handler,
+	// recorded by Server.Serve
+	mu          sync.Mutex
+	listenAddrs []net.Addr
+}
+
+// Dialer opens upstream connections, it is satisfied by *net.Dialer so custom
+// resolvers, source addresses and test fakes can be plugged in
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 // ProxyConnection proxy a TLS connection
-func (tlsh *TLSHandler) ProxyConnection(cin *net.TCPConn) {
+func (tlsh *TLSHandler) ProxyConnection(cin net.Conn) {
 	s := NewSession(cin)
+	s.handler = tlsh
 	go s.Start()
 }
 
+func (tlsh *TLSHandler) ruleset() *Ruleset {
+	if tlsh.Ruleset == nil {
+		return defaultRuleset
+	}
+	return tlsh.Ruleset
+}
+
+func (tlsh *TLSHandler) resolver() *net.Resolver {
+	if tlsh.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return tlsh.Resolver
+}
+
+// addListenAddr record the address of a listener serving this handler
+func (tlsh *TLSHandler) addListenAddr(addr net.Addr) {
+	tlsh.mu.Lock()
+	defer tlsh.mu.Unlock()
+	tlsh.listenAddrs = append(tlsh.listenAddrs, addr)
+}
+
+// isListenAddr check if the address is one of the handler's listeners, for
+// listeners on the unspecified address any local address on the same port
+// matches.
+func (tlsh *TLSHandler) isListenAddr(addr *net.TCPAddr) bool {
+	tlsh.mu.Lock()
+	defer tlsh.mu.Unlock()
+
+	for _, la := range tlsh.listenAddrs {
+		tcpAddr, ok := la.(*net.TCPAddr)
+		if !ok || tcpAddr.Port != addr.Port {
+			continue
+		}
+		if tcpAddr.IP.Equal(addr.IP) {
+			return true
+		}
+		if tcpAddr.IP.IsUnspecified() && isLocalIP(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLocalIP check if the IP is assigned to one of the host's interfaces
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tlsh *TLSHandler) dialPort() int {
+	if tlsh.DialPort == 0 {
+		return defaultDialPort
+	}
+	return tlsh.DialPort
+}
+
+// DestinationWarnings describe the rules whose destination conditions don't
+// apply to the address the handler connects to. Destinations and ports are
+// checked against the original destination, but unless the handler dials the
+// original destination it connects to wherever the SNI hostname resolves, so a
+// client can send a name which resolves to a denied address.
+//
+// Destinations are only safe with DialOriginalDestination or SNIVerifyReject,
+// and ports with any dial mode using the original port.
+func (tlsh *TLSHandler) DestinationWarnings() []string {
+	var warnings []string
+
+	for _, r := range tlsh.ruleset().Rules() {
+		if len(r.Destinations) != 0 && tlsh.DialMode != DialOriginalDestination && tlsh.VerifySNI != SNIVerifyReject {
+			warnings = append(warnings, fmt.Sprintf("Rule %s has destinations which aren't enforced unless dialing the original destination or rejecting unverified SNI", r.Name))
+		}
+		if len(r.Ports) != 0 && tlsh.DialMode == DialSNI {
+			warnings = append(warnings, fmt.Sprintf("Rule %s has ports which aren't enforced when dialing the SNI hostname on a fixed port", r.Name))
+		}
+	}
+
+	return warnings
+}
+
 func generateID() string {
 	r := make([]byte, 10)
 	_, err := rand.Read(r)
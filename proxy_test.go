@@ -0,0 +1,478 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialerFunc a Dialer which calls the function
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// testUpstream start a TLS server which responds with ok, returning it along
+// with its port
+func testUpstream(t *testing.T) (*httptest.Server, int) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return upstream, port
+}
+
+// testProxy start the proxy using the handler, returning its address
+func testProxy(t *testing.T, handler Handler) string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := &Server{Handler: handler}
+
+	go srv.Serve(l)
+
+	return l.Addr().String()
+}
+
+// proxyGet request https://serverName:port/ through the proxy, the upstream
+// certificate isn't verified
+func proxyGet(proxyAddr, serverName string, port int) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, proxyAddr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	res, err := client.Get("https://" + net.JoinHostPort(serverName, strconv.Itoa(port)) + "/")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	return string(body), err
+}
+
+func TestVerifySNI(t *testing.T) {
+
+	var verifytests = []struct {
+		origAddr *net.TCPAddr
+		ok       bool
+	}{
+		{origAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, ok: true},
+		{origAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, ok: false},
+		{origAddr: nil, ok: false},
+	}
+
+	for _, tt := range verifytests {
+		s := &Session{
+			handler:  &TLSHandler{VerifySNI: SNIVerifyReject},
+			origAddr: tt.origAddr,
+			Log:      log.Log,
+		}
+
+		err := s.verifySNI("localhost")
+		assert.Equal(t, tt.ok, err == nil, "origAddr %v: %v", tt.origAddr, err)
+	}
+}
+
+func TestValidateCerts(t *testing.T) {
+
+	upstream, _ := testUpstream(t)
+
+	// the httptest certificate is for example.com but isn't trusted
+	raw := [][]byte{upstream.Certificate().Raw}
+
+	s := &Session{Log: log.Log}
+
+	err := s.validateCerts("localhost", nil)
+	assert.EqualError(t, err, "server sent no certificates")
+
+	err = s.validateCerts("github.com", raw)
+	assert.IsType(t, x509.HostnameError{}, err)
+
+	err = s.validateCerts("example.com", raw)
+	assert.IsType(t, x509.UnknownAuthorityError{}, err)
+}
+
+func TestProxyMonitor(t *testing.T) {
+
+	_, port := testUpstream(t)
+
+	var monitortests = []struct {
+		rules   vals
+		monitor bool
+		ok      bool
+	}{
+		{rules: vals{"001": vals{"exact": "localhost", "action": "deny"}}, monitor: false, ok: false},
+		{rules: vals{"001": vals{"exact": "localhost", "action": "deny"}}, monitor: true, ok: true},
+		{rules: vals{"001": vals{"exact": "localhost", "action": "monitor"}, "002": vals{"exact": "localhost", "action": "allow"}}, monitor: false, ok: true},
+		// a monitor rule never lets through what a later rule denies
+		{rules: vals{"001": vals{"exact": "localhost", "action": "monitor"}, "002": vals{"exact": "localhost", "action": "deny"}}, monitor: false, ok: false},
+	}
+
+	for _, tt := range monitortests {
+		rs, err := NewRuleset(tt.rules)
+		assert.Nil(t, err)
+
+		proxyAddr := testProxy(t, &TLSHandler{Ruleset: rs, DialPort: port, Monitor: tt.monitor})
+
+		body, err := proxyGet(proxyAddr, "localhost", port)
+		if !tt.ok {
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), "access denied")
+			}
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", body)
+	}
+}
+
+func TestProxyMonitorInvalidHostname(t *testing.T) {
+
+	_, port := testUpstream(t)
+
+	var dials int32
+
+	handler := &TLSHandler{
+		Ruleset:  &Ruleset{},
+		DialPort: port,
+		Monitor:  true,
+		Dialer: dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+	}
+
+	proxyAddr := testProxy(t, handler)
+
+	// monitor mode doesn't let through a hostname which can't be dialed
+	_, err := proxyGet(proxyAddr, "xn--zz.example", port)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "access denied")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+}
+
+func TestProxyDefaultAction(t *testing.T) {
+
+	_, port := testUpstream(t)
+
+	for _, action := range []string{"allow", "deny"} {
+		rs := &Ruleset{}
+		err := rs.LoadConfig(RulesetConfig{DefaultAction: action})
+		assert.Nil(t, err)
+
+		proxyAddr := testProxy(t, &TLSHandler{Ruleset: rs, DialPort: port})
+
+		body, err := proxyGet(proxyAddr, "localhost", port)
+		if action == "deny" {
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), "access denied")
+			}
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", body)
+	}
+}
+
+func TestProxyRoute(t *testing.T) {
+
+	upstream, port := testUpstream(t)
+
+	// nothing listens on the closed port so the first upstream fails
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closed.Close()
+
+	var routetests = []vals{
+		{"exact": "registry.example.com", "action": "route", "upstream": upstream.Listener.Addr().String()},
+		{"exact": "registry.example.com", "action": "route", "upstreams": []string{closed.Addr().String(), upstream.Listener.Addr().String()}},
+		{"exact": "registry.example.com", "action": "route", "rewrite_sni": "localhost"},
+	}
+
+	for _, rule := range routetests {
+		rs, err := NewRuleset(vals{"001": rule})
+		assert.Nil(t, err)
+
+		proxyAddr := testProxy(t, &TLSHandler{Ruleset: rs, DialPort: port})
+
+		body, err := proxyGet(proxyAddr, "registry.example.com", port)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", body)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+
+	upstream, port := testUpstream(t)
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "registry.example.com", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	dialed := make(chan string, 1)
+	deadline := make(chan bool, 1)
+
+	// resolve every name to the upstream
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		_, ok := ctx.Deadline()
+		deadline <- ok
+		return (&net.Dialer{}).DialContext(ctx, network, upstream.Listener.Addr().String())
+	})
+
+	proxyAddr := testProxy(t, &TLSHandler{Ruleset: rs, Dialer: dialer})
+
+	body, err := proxyGet(proxyAddr, "registry.example.com", port)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, "registry.example.com:443", <-dialed)
+	assert.True(t, <-deadline, "dial should have a timeout")
+}
+
+func TestSessionPipe(t *testing.T) {
+
+	upstream, port := testUpstream(t)
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "localhost", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	dialer := dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, upstream.Listener.Addr().String())
+	})
+
+	cin, cout := net.Pipe()
+
+	handler := &TLSHandler{Ruleset: rs, Dialer: dialer}
+	handler.ProxyConnection(cout)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return cin, nil
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	res, err := client.Get("https://" + net.JoinHostPort("localhost", strconv.Itoa(port)) + "/")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestProxyScheduleTerminate(t *testing.T) {
+
+	_, port := testUpstream(t)
+
+	// half a second before the window closes
+	now := time.Date(2016, 6, 6, 16, 59, 59, 500000000, time.UTC)
+
+	rs := &Ruleset{Clock: func() time.Time { return now }}
+	err := rs.LoadConfig(RulesetConfig{Rules: vals{
+		"001": vals{"exact": "localhost", "action": "allow", "times": []string{"09:00-17:00"}, "terminate": true},
+	}})
+	assert.Nil(t, err)
+
+	proxyAddr := testProxy(t, &TLSHandler{Ruleset: rs, DialPort: port})
+
+	conn, err := tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+
+	// the upstream waits for a request so the read only returns once the
+	// proxy closes the session
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < 4*time.Second, "session not terminated: %s", elapsed)
+	assert.True(t, elapsed > 250*time.Millisecond, "session terminated early: %s", elapsed)
+}
+
+func TestDestinationWarnings(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": ".*", "action": "deny", "destinations": []string{"169.254.169.254"}},
+		"002": vals{"suffix": "internal.corp", "action": "allow", "ports": []int{8443}},
+	})
+	assert.Nil(t, err)
+
+	var warningtests = []struct {
+		handler  *TLSHandler
+		expected []string
+	}{
+		{
+			handler: &TLSHandler{Ruleset: rs},
+			expected: []string{
+				"Rule 001 has destinations which aren't enforced unless dialing the original destination or rejecting unverified SNI",
+				"Rule 002 has ports which aren't enforced when dialing the SNI hostname on a fixed port",
+			},
+		},
+		{
+			handler: &TLSHandler{Ruleset: rs, DialMode: DialSNIOriginalPort},
+			expected: []string{
+				"Rule 001 has destinations which aren't enforced unless dialing the original destination or rejecting unverified SNI",
+			},
+		},
+		{handler: &TLSHandler{Ruleset: rs, DialMode: DialSNIOriginalPort, VerifySNI: SNIVerifyReject}},
+		{handler: &TLSHandler{Ruleset: rs, DialMode: DialOriginalDestination}},
+	}
+
+	for _, tt := range warningtests {
+		assert.Equal(t, tt.expected, tt.handler.DestinationWarnings())
+	}
+}
+
+func TestParseDialMode(t *testing.T) {
+
+	var modetests = []struct {
+		mode     string
+		expected DialMode
+		err      string
+	}{
+		{mode: "", expected: DialSNI},
+		{mode: "sni", expected: DialSNI},
+		{mode: "sni-origport", expected: DialSNIOriginalPort},
+		{mode: "origdst", expected: DialOriginalDestination},
+		{mode: "SNI", expected: DialSNI, err: "invalid dial mode: SNI"},
+		{mode: "direct", expected: DialSNI, err: "invalid dial mode: direct"},
+	}
+
+	for _, tt := range modetests {
+		mode, err := ParseDialMode(tt.mode)
+		assert.Equal(t, tt.expected, mode, tt.mode)
+		if tt.err == "" {
+			assert.Nil(t, err, tt.mode)
+			continue
+		}
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestUpstreamAddr(t *testing.T) {
+
+	origAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 8443}
+
+	var addrtests = []struct {
+		handler  *TLSHandler
+		laddr    net.Addr
+		origAddr *net.TCPAddr
+		expected string
+		err      string
+	}{
+		{handler: &TLSHandler{}, expected: "github.com:443"},
+		{handler: &TLSHandler{}, origAddr: origAddr, expected: "github.com:443"},
+		{handler: &TLSHandler{DialPort: 8443}, expected: "github.com:8443"},
+		{handler: &TLSHandler{DialMode: DialSNIOriginalPort, DialPort: 9443}, origAddr: origAddr, expected: "github.com:8443"},
+		{handler: &TLSHandler{DialMode: DialSNIOriginalPort}, err: "original destination is not available"},
+		{handler: &TLSHandler{DialMode: DialOriginalDestination}, origAddr: origAddr, expected: "192.0.2.10:8443"},
+		{handler: &TLSHandler{DialMode: DialOriginalDestination}, err: "original destination is not available"},
+		{handler: &TLSHandler{DialMode: DialOriginalDestination}, laddr: origAddr, origAddr: origAddr, err: "original destination 192.0.2.10:8443 is the proxy's own address"},
+		{handler: &TLSHandler{DialMode: DialOriginalDestination, Transparent: true}, laddr: origAddr, origAddr: origAddr, expected: "192.0.2.10:8443"},
+	}
+
+	for i, tt := range addrtests {
+		s := &Session{
+			handler:  tt.handler,
+			laddr:    tt.laddr,
+			origAddr: tt.origAddr,
+			Log:      log.Log,
+		}
+
+		addr, err := s.upstreamAddr("github.com")
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, i)
+			continue
+		}
+		assert.Nil(t, err, i)
+		assert.Equal(t, tt.expected, addr, i)
+	}
+}
+
+func TestProxySelfDestination(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "localhost", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	var dials int32
+
+	handler := &TLSHandler{
+		Ruleset: rs,
+		// in transparent mode the listener's address is the original
+		// destination of a client connecting straight to it
+		Transparent: true,
+		DialMode:    DialOriginalDestination,
+		Dialer: dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+	}
+
+	proxyAddr := testProxy(t, handler)
+
+	_, port, err := net.SplitHostPort(proxyAddr)
+	assert.Nil(t, err)
+
+	p, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+
+	_, err = proxyGet(proxyAddr, "localhost", p)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+}
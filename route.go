@@ -0,0 +1,95 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// buildRoute check the route attributes, they are required by route rules
+// and can't be used by any other action
+func (r *Rule) buildRoute() error {
+
+	set := 0
+	if r.Upstream != "" {
+		set++
+	}
+	if len(r.Upstreams) != 0 {
+		set++
+	}
+	if r.RewriteSNI != "" {
+		set++
+	}
+
+	if r.action != ActionRoute {
+		if set != 0 {
+			return fmt.Errorf("Rule %s has upstream, upstreams or rewrite_sni but the action isn't route", r.Name)
+		}
+		return nil
+	}
+
+	if set != 1 {
+		return fmt.Errorf("Rule %s must have one of upstream, upstreams or rewrite_sni", r.Name)
+	}
+
+	r.upstreams = r.Upstreams
+	if r.Upstream != "" {
+		r.upstreams = []string{r.Upstream}
+	}
+
+	for _, addr := range r.upstreams {
+		if err := validateUpstream(addr); err != nil {
+			return fmt.Errorf("Rule %s has an invalid upstream: %s", r.Name, err)
+		}
+	}
+
+	if r.RewriteSNI != "" {
+		host, err := parseHostname(r.RewriteSNI)
+		if err != nil {
+			return fmt.Errorf("Rule %s has an invalid rewrite_sni: %s", r.Name, r.RewriteSNI)
+		}
+		r.rewriteSNI = host
+	}
+
+	return nil
+}
+
+// validateUpstream check the address is a host:port
+func validateUpstream(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		return fmt.Errorf("missing host in %s", addr)
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+
+	return nil
+}
+
+// route the upstreams of the rule in the order they should be tried, each call
+// starts with the next upstream so connections are spread across them
+func (r *Rule) route() []string {
+	n := len(r.upstreams)
+	if n < 2 {
+		return r.upstreams
+	}
+
+	start := int((atomic.AddUint32(&r.next, 1) - 1) % uint32(n))
+
+	upstreams := make([]string, 0, n)
+	upstreams = append(upstreams, r.upstreams[start:]...)
+	upstreams = append(upstreams, r.upstreams[:start]...)
+
+	return upstreams
+}
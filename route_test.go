@@ -0,0 +1,61 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+
+	var routetests = []struct {
+		rule vals
+		err  string
+	}{
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "upstream": "mirror.internal:443"}},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "upstreams": []string{"10.0.0.1:443", "[2001:db8::1]:443"}}},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "rewrite_sni": "mirror.internal"}},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route"}, err: "Rule 001 must have one of upstream, upstreams or rewrite_sni"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "upstream": "mirror.internal:443", "rewrite_sni": "mirror.internal"}, err: "Rule 001 must have one of upstream, upstreams or rewrite_sni"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "allow", "upstream": "mirror.internal:443"}, err: "Rule 001 has upstream, upstreams or rewrite_sni but the action isn't route"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "upstream": "mirror.internal"}, err: "Rule 001 has an invalid upstream: address mirror.internal: missing port in address"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "upstream": "mirror.internal:https"}, err: "Rule 001 has an invalid upstream: invalid port in mirror.internal:https"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "rewrite_sni": "mirror..internal"}, err: "Rule 001 has an invalid rewrite_sni: mirror..internal"},
+		{rule: vals{"exact": "registry.npmjs.org", "action": "route", "rewrite_sni": strings.Repeat("a", 64) + ".internal"}, err: "Rule 001 has an invalid rewrite_sni: " + strings.Repeat("a", 64) + ".internal"},
+	}
+
+	for _, tt := range routetests {
+		_, err := NewRuleset(vals{"001": tt.rule})
+		if tt.err == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "registry.npmjs.org", "action": "route", "upstreams": []string{"a:443", "b:443", "c:443"}},
+	})
+	assert.Nil(t, err)
+
+	var expected = [][]string{
+		{"a:443", "b:443", "c:443"},
+		{"b:443", "c:443", "a:443"},
+		{"c:443", "a:443", "b:443"},
+		{"a:443", "b:443", "c:443"},
+	}
+
+	for _, upstreams := range expected {
+		rm := rs.MatchRule("registry.npmjs.org")
+		assert.Equal(t, ActionRoute, rm.Action)
+		assert.Equal(t, upstreams, rm.Upstreams)
+	}
+}
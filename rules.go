@@ -6,20 +6,113 @@ package l7proxify
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/google/cel-go/cel"
 	"github.com/mitchellh/mapstructure"
 )
 
 // Rule a filter rule for hosts
 type Rule struct {
-	Name    string
-	Match   string
-	Action  string
-	Enabled bool
+	Name string
+	// Match a regular expression matched against the hostname
+	Match string
+	// Exact matches a single hostname
+	Exact string
+	// Suffix matches a domain and its subdomains on a label boundary, with a
+	// leading dot only subdomains are matched
+	Suffix string
+	// Wildcard matches a pattern where * matches any single label
+	Wildcard string
+	// List the path of a file of domains, the entries are matched depending on
+	// the format which is one of domains, hosts or adblock
+	List     string
+	Format   string
+	Action   string
+	Enabled  bool
+	Priority int
+	// Alert the TLS alert sent to the client when the rule denies a connection
+	Alert string
 
-	cregx *regexp.Regexp
+	// Description, Owner and Ticket are logged when the rule matches
+	Description string
+	Owner       string
+	Ticket      string
+	// Expires the date, or RFC 3339 timestamp, after which the rule is disabled
+	Expires string
+
+	// Sources the client networks the rule applies to, as CIDRs or addresses
+	Sources []string
+	// Groups the names of client groups the rule applies to, a rule with
+	// neither sources or groups applies to all clients
+	Groups []string
+
+	// Ports and Destinations limit the rule to connections with an original
+	// destination on one of the ports, or in one of the networks
+	Ports        []int
+	Destinations []string
+
+	// ALPN limits the rule to clients offering one of the application
+	// protocols, MinTLSVersion to clients supporting at least that version
+	// and DenyCiphers to clients offering none of the cipher suites.
+	// MaxTLSVersion and OffersCiphers do the reverse, limiting the rule to
+	// clients supporting at most that version or offering one of the cipher
+	// suites, so a deny rule can match legacy clients.
+	ALPN          []string
+	MinTLSVersion string   `mapstructure:"min_tls_version"`
+	MaxTLSVersion string   `mapstructure:"max_tls_version"`
+	DenyCiphers   []string `mapstructure:"deny_ciphers"`
+	OffersCiphers []string `mapstructure:"offers_ciphers"`
+
+	// Days and Times limit the rule to a schedule, for example mon to fri
+	// and 09:00-17:00, in the Timezone which defaults to UTC. With Terminate
+	// set sessions are closed when the window they were opened in ends.
+	Days      []string
+	Times     []string
+	Timezone  string
+	Terminate bool
+
+	// Upstream, or a list of Upstreams used in turn, is the host:port route
+	// rules connect to in place of the SNI hostname. RewriteSNI instead
+	// connects to another hostname on the port chosen by the dial mode. The
+	// client hello is relayed unchanged in either case.
+	Upstream   string
+	Upstreams  []string
+	RewriteSNI string `mapstructure:"rewrite_sni"`
+
+	// Proxy the parent proxy connections matching the rule are made through,
+	// overriding the proxy set on the handler, or direct to bypass it
+	Proxy string
+
+	// Expr a CEL expression which must evaluate to true for the rule to
+	// match, it can be used on its own or along with a hostname attribute
+	Expr string
+
+	action        int
+	matcher       hostMatcher
+	sources       []*net.IPNet
+	groups        []*clientGroup
+	destinations  []*net.IPNet
+	minVersion    uint16
+	maxVersion    uint16
+	denyCiphers   map[uint16]bool
+	offersCiphers map[uint16]bool
+	program       cel.Program
+	schedule      *schedule
+	upstreams     []string
+	rewriteSNI    string
+	next          uint32
+	proxy         *url.URL
+	alert         alert
+	expires       time.Time
+	expiredOnce   sync.Once
 }
 
 func (r *Rule) validate() (err error) {
@@ -27,32 +120,255 @@ func (r *Rule) validate() (err error) {
 		return fmt.Errorf("Rule is missing name: %v", r)
 	}
 
-	switch r.Action {
-	case "allow":
-	case "deny":
-	default:
+	var ok bool
+
+	r.action, ok = parseAction(r.Action)
+	if !ok {
 		return fmt.Errorf("Rule has an invalid action: %v", r.Action)
 	}
 
-	r.cregx, err = regexp.Compile(r.Match)
+	r.alert = defaultDenyAlert
 
+	if r.Alert != "" {
+		a, ok := parseAlert(r.Alert)
+		if !ok {
+			return fmt.Errorf("Rule has an invalid alert: %v", r.Alert)
+		}
+		r.alert = a
+	}
+
+	if r.Expires != "" {
+		r.expires, err = parseExpires(r.Expires)
+		if err != nil {
+			return fmt.Errorf("Rule has an invalid expiry: %v", r.Expires)
+		}
+	}
+
+	r.matcher, err = r.buildMatcher()
 	if err != nil {
-		return fmt.Errorf("Error compiling match regexp %s", err)
+		return err
+	}
+
+	if err := r.buildDestination(); err != nil {
+		return err
+	}
+
+	if err := r.buildTLS(); err != nil {
+		return err
+	}
+
+	if err := r.buildSchedule(); err != nil {
+		return err
+	}
+
+	if err := r.buildRoute(); err != nil {
+		return err
+	}
+
+	if r.Proxy != "" && r.Proxy != "direct" {
+		r.proxy, err = ParseParentProxy(r.Proxy)
+		if err != nil {
+			return fmt.Errorf("Rule %s has an invalid proxy: %s", r.Name, err)
+		}
+	}
+
+	if r.Expr != "" {
+		r.program, err = compileExpr(r.Expr)
+		if err != nil {
+			return fmt.Errorf("Rule %s has an invalid expr: %s", r.Name, err)
+		}
 	}
 
 	return nil
 }
 
-// ruleset is global to the application and stored here
-var ruleset = []*Rule{}
+// buildMatcher build the matcher for the hostname attribute set on the rule,
+// only one can be used. A rule with an expression may leave it out and match
+// on the expression alone.
+func (r *Rule) buildMatcher() (hostMatcher, error) {
+
+	set := 0
+	for _, attr := range []string{r.Match, r.Exact, r.Suffix, r.Wildcard, r.List} {
+		if attr != "" {
+			set++
+		}
+	}
+
+	if set == 0 && r.Expr != "" {
+		return &anyMatcher{}, nil
+	}
+
+	if set != 1 {
+		return nil, fmt.Errorf("Rule %s must have one of match, exact, suffix, wildcard or list", r.Name)
+	}
 
-// LoadRuleset load the rule set supplied by configuration
+	switch {
+	case r.Exact != "":
+		host, err := parseHostname(r.Exact)
+		if err != nil {
+			return nil, fmt.Errorf("Rule has an invalid exact match: %s", err)
+		}
+		return &exactMatcher{host: host}, nil
+	case r.Suffix != "":
+		m, err := newSuffixMatcher(r.Suffix)
+		if err != nil {
+			return nil, fmt.Errorf("Rule has an invalid suffix match: %s", err)
+		}
+		return m, nil
+	case r.List != "":
+		m, err := loadDomainList(r.List, r.Format)
+		if err != nil {
+			return nil, fmt.Errorf("Rule has an invalid list: %s", err)
+		}
+		return m, nil
+	case r.Wildcard != "":
+		m, err := newWildcardMatcher(r.Wildcard)
+		if err != nil {
+			return nil, fmt.Errorf("Rule has an invalid wildcard match: %s", err)
+		}
+		return m, nil
+	}
+
+	cregx, err := regexp.Compile(r.Match)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling match regexp %s", err)
+	}
+
+	return &regexpMatcher{cregx: cregx}, nil
+}
+
+// active check the rule is enabled and hasn't expired, a warning is logged the
+// first time an expired rule is skipped.
+func (r *Rule) active(now time.Time) bool {
+	if !r.Enabled {
+		return false
+	}
+
+	if !r.expires.IsZero() && now.After(r.expires) {
+		r.expiredOnce.Do(func() {
+			log.WithFields(log.Fields{
+				"name":    r.Name,
+				"expires": r.Expires,
+				"owner":   r.Owner,
+				"ticket":  r.Ticket,
+			}).Warn("Rule has expired and is disabled")
+		})
+		return false
+	}
+
+	return true
+}
+
+// parseExpires accept either a date which expires at the end of that day in
+// UTC, or an RFC 3339 timestamp.
+func parseExpires(expires string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", expires)
+	if err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+
+	return time.Parse(time.RFC3339, expires)
+}
+
+// defaultDenyAlert sent to the client when a connection is denied and the rule
+// doesn't specify an alert, or no rule matched
+const defaultDenyAlert = alertAccessDenied
+
+// Ruleset an ordered set of rules used to decide the action for a connection.
+//
+// A Ruleset is safe for concurrent use, the rules are replaced as a whole when
+// it is reloaded so sessions either see the old or the new rules.
+type Ruleset struct {
+	// Clock returns the time rules are matched at, used for expiry, schedules
+	// and expressions. Defaults to time.Now.
+	Clock func() time.Time
+
+	mu    sync.RWMutex
+	state *rulesetState
+}
+
+// rulesetState the rules along with the index used to look them up, this is
+// never modified once loaded so can be used without holding the lock
+type rulesetState struct {
+	rules  []*Rule
+	groups map[string]*clientGroup
+	// defaultAction used when no rule matches, nil when not configured
+	defaultAction *int
+	// index of the exact and suffix rules
+	index *domainTrie
+	// scan the positions of the rules which can't be indexed
+	scan []int
+}
+
+func newRulesetState(rules []*Rule, groups map[string]*clientGroup) *rulesetState {
+	st := &rulesetState{
+		rules:  rules,
+		groups: groups,
+		index:  newDomainTrie(),
+	}
+
+	for i, r := range rules {
+		if !st.index.insert(i, r.matcher) {
+			st.scan = append(st.scan, i)
+		}
+	}
+
+	return st
+}
+
+// NewRuleset build a ruleset from the rules supplied by configuration
+func NewRuleset(rules map[string]interface{}) (*Ruleset, error) {
+	rs := &Ruleset{}
+
+	if err := rs.LoadConfig(RulesetConfig{Rules: rules}); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// RulesetConfig the rules and client groups supplied by configuration
+type RulesetConfig struct {
+	Rules  map[string]interface{}
+	Groups map[string]interface{}
+	// DefaultAction the action when no rule matches, one of allow, deny or
+	// monitor. When empty Match returns nil and the caller decides.
+	DefaultAction string
+}
+
+// LoadConfig load the rules and client groups supplied by configuration
+//
+// The new rules replace any loaded previously in a single step. If any rule is
+// invalid an error is returned and the existing rules are kept.
+//
+// Rules are evaluated in order of priority, lowest first, which is either set
+// with the priority attribute or taken from the rule name when it is a number,
+// for example rules.001. Two rules with the same priority are rejected as the
+// order they are evaluated in would be ambiguous.
 //
 // Need to rejig this to return a list of errors as it will be a pain for
 // larger rule sets.
-func LoadRuleset(rules map[string]interface{}) error {
-	for k, v := range rules {
-		r := new(Rule)
+func (rs *Ruleset) LoadConfig(cfg RulesetConfig) error {
+	groups, err := loadGroups(cfg.Groups)
+	if err != nil {
+		return err
+	}
+
+	var defaultAction *int
+
+	if cfg.DefaultAction != "" {
+		action, ok := parseAction(cfg.DefaultAction)
+		if !ok || action == ActionRoute {
+			return fmt.Errorf("Ruleset has an invalid default action: %s", cfg.DefaultAction)
+		}
+		defaultAction = &action
+	}
+
+	loaded := []*Rule{}
+
+	for k, v := range cfg.Rules {
+		// rules are enabled unless switched off in configuration
+		r := &Rule{Enabled: true}
 
 		if err := mapstructure.Decode(v, r); err != nil {
 			return err
@@ -64,45 +380,290 @@ func LoadRuleset(rules map[string]interface{}) error {
 			return err
 		}
 
-		ruleset = append(ruleset, r)
+		if err := r.buildClient(groups); err != nil {
+			return err
+		}
+
+		if !hasPriority(v) {
+			p, err := strconv.Atoi(k)
+			if err != nil {
+				return fmt.Errorf("Rule %s has no priority and the name is not a number", k)
+			}
+			r.Priority = p
+		}
+
+		loaded = append(loaded, r)
 
 		log.WithField("rule", r).Debug("parsed rule")
 	}
 
+	sort.Slice(loaded, func(i, j int) bool {
+		if loaded[i].Priority == loaded[j].Priority {
+			return loaded[i].Name < loaded[j].Name
+		}
+		return loaded[i].Priority < loaded[j].Priority
+	})
+
+	for i := 1; i < len(loaded); i++ {
+		if loaded[i].Priority == loaded[i-1].Priority {
+			return fmt.Errorf("Rules %s and %s have the same priority %d", loaded[i-1].Name, loaded[i].Name, loaded[i].Priority)
+		}
+	}
+
+	st := newRulesetState(loaded, groups)
+	st.defaultAction = defaultAction
+
+	rs.mu.Lock()
+	rs.state = st
+	rs.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"count":         len(loaded),
+		"groups":        len(groups),
+		"defaultAction": cfg.DefaultAction,
+	}).Info("loaded ruleset")
+
 	return nil
 }
 
+// Rules return the active rules in priority order, the slice is never
+// modified once loaded so can be used without holding the lock
+func (rs *Ruleset) Rules() []*Rule {
+	return rs.current().rules
+}
+
+func (rs *Ruleset) now() time.Time {
+	if rs.Clock != nil {
+		return rs.Clock()
+	}
+	return time.Now()
+}
+
+func (rs *Ruleset) current() *rulesetState {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if rs.state == nil {
+		return &rulesetState{index: newDomainTrie()}
+	}
+	return rs.state
+}
+
+// Files return the paths of the domain lists used by the rules, these need to
+// be watched so the ruleset can be reloaded when they change
+func (rs *Ruleset) Files() []string {
+	var files []string
+	for _, r := range rs.Rules() {
+		if m, ok := r.matcher.(*domainListMatcher); ok {
+			files = append(files, m.path)
+		}
+	}
+	return files
+}
+
+// hasPriority check if the priority attribute was set on the rule
+func hasPriority(v interface{}) bool {
+	var attrs struct {
+		Priority *int
+	}
+	if err := mapstructure.Decode(v, &attrs); err != nil {
+		return false
+	}
+	return attrs.Priority != nil
+}
+
 const (
 	// ActionReject reject the connection
 	ActionReject = iota
 	// ActionAccept accept the connection
 	ActionAccept
+	// ActionMonitor log that the connection would be rejected and evaluate the
+	// following rules
+	ActionMonitor
+	// ActionRoute accept the connection and send it to the upstream of the rule
+	ActionRoute
 )
 
+// parseAction the action for the name used in configuration
+func parseAction(name string) (int, bool) {
+	switch name {
+	case "allow":
+		return ActionAccept, true
+	case "deny":
+		return ActionReject, true
+	case "monitor":
+		return ActionMonitor, true
+	case "route":
+		return ActionRoute, true
+	}
+	return 0, false
+}
+
 // RuleMatch match information returned for a given rule scan
 type RuleMatch struct {
 	Action int
 	Rule   *Rule
+	// Group the client group which matched, empty when the rule matched on
+	// sources or applies to all clients
+	Group string
+	// Until when the schedule of the rule closes, only set for rules which
+	// terminate sessions
+	Until time.Time
+	// Default set when no rule matched and the default action was used
+	Default bool
+	// Upstreams the addresses a route rule connects to, in the order they
+	// should be tried
+	Upstreams []string
+	// Reason why the connection is rejected without matching a rule or using
+	// the default action, such as an invalid hostname
+	Reason string
+}
+
+// ruleName the name of the matched rule, empty when no rule matched
+func (rm *RuleMatch) ruleName() string {
+	if rm.Rule == nil {
+		return ""
+	}
+	return rm.Rule.Name
+}
+
+// alert the alert sent when the connection is rejected
+func (rm *RuleMatch) alert() alert {
+	if rm.Rule == nil {
+		return defaultDenyAlert
+	}
+	return rm.Rule.alert
+}
+
+// MatchRule run through the ruleset looking for matches on the hostname alone,
+// rules limited to particular clients, destinations or TLS parameters never
+// match, see Match.
+func (rs *Ruleset) MatchRule(host string) *RuleMatch {
+	return rs.Match(&MatchRequest{ServerName: host})
 }
 
-// MatchRule run through the ruleset looking for matches
+// Match run through the ruleset looking for matches
 //
 // This routine will loop over the ruleset and if a rule matches then
-// return the corresponding action, otherwise return nil which
-// enables the caller to decide on the default action
+// return the corresponding action, monitor rules which match are logged and
+// skipped. Otherwise return the default action of the ruleset, or if that
+// isn't set return nil which enables the caller to decide. The hostname is
+// normalised before matching, see normaliseHost, one which can't be is always
+// rejected.
 //
-func MatchRule(host string) *RuleMatch {
+// Exact and suffix rules are looked up in the index, and the candidates merged
+// with the rules which need to be scanned so the first match still wins.
+func (rs *Ruleset) Match(req *MatchRequest) *RuleMatch {
+
+	host, err := normaliseHost(req.ServerName)
+	if err != nil {
+		log.WithError(err).Debug("hostname not matched")
+		return &RuleMatch{Action: ActionReject, Reason: "invalid hostname"}
+	}
+
+	now := rs.now()
+
+	st := rs.current()
+
+	candidates := st.index.lookup(host)
+
+	// the expression variables are only built if a rule needs them
+	var vars map[string]interface{}
+
+	for i, j := 0, 0; i < len(candidates) || j < len(st.scan); {
+		var idx int
+		if j == len(st.scan) || (i < len(candidates) && candidates[i] < st.scan[j]) {
+			idx = candidates[i]
+			i++
+		} else {
+			idx = st.scan[j]
+			j++
+		}
+
+		r := st.rules[idx]
+
+		if !r.active(now) {
+			continue
+		}
+		if !r.matcher.matchHost(host) {
+			continue
+		}
+
+		group, ok := r.matchClient(req.ClientIP)
+		if !ok {
+			continue
+		}
+
+		if !r.matchDestination(req.DestIP, req.DestPort) {
+			continue
+		}
+
+		if !r.matchTLS(req) {
+			continue
+		}
+
+		if r.schedule != nil && !r.schedule.active(now) {
+			continue
+		}
 
-	for _, r := range ruleset {
-		if r.cregx.MatchString(host) {
-			switch r.Action {
-			case "allow":
-				return &RuleMatch{Rule: r, Action: ActionAccept}
-			case "deny":
-				return &RuleMatch{Rule: r, Action: ActionReject}
+		if r.program != nil {
+			if vars == nil {
+				vars = exprActivation(req, host, clientGroups(st.groups, req.ClientIP), now)
+			}
+			if !r.matchExpr(vars) {
+				continue
 			}
 		}
+
+		// a monitor rule is only logged, the connection is decided by the
+		// rules after it or the default action so it can't loosen enforcement
+		if r.action == ActionMonitor {
+			log.WithFields(log.Fields{
+				"name":        r.Name,
+				"serverName":  host,
+				"description": r.Description,
+				"owner":       r.Owner,
+				"ticket":      r.Ticket,
+			}).Warn("Monitor rule matched, connection would be rejected")
+			continue
+		}
+
+		rm := &RuleMatch{Rule: r, Group: group}
+
+		if r.Terminate {
+			rm.Until = r.schedule.closes(now)
+		}
+
+		rm.Action = r.action
+
+		if r.action == ActionRoute {
+			rm.Upstreams = r.route()
+		}
+
+		return rm
+	}
+
+	if st.defaultAction != nil {
+		return &RuleMatch{Action: *st.defaultAction, Default: true}
 	}
 
 	return nil
 }
+
+// defaultRuleset used by the package level functions and any TLSHandler which
+// isn't given a ruleset
+var defaultRuleset = &Ruleset{}
+
+// LoadRuleset load the rule set supplied by configuration into the default
+// ruleset.
+//
+// Deprecated: build a Ruleset with NewRuleset and pass it to the TLSHandler.
+func LoadRuleset(rules map[string]interface{}) error {
+	return defaultRuleset.LoadConfig(RulesetConfig{Rules: rules})
+}
+
+// MatchRule run through the default ruleset looking for matches.
+//
+// Deprecated: use Ruleset.MatchRule.
+func MatchRule(host string) *RuleMatch {
+	return defaultRuleset.MatchRule(host)
+}
@@ -5,7 +5,7 @@ package l7proxify
 // license which can be found in the LICENSE file.
 
 import (
-	"reflect"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,35 +16,319 @@ type vals map[string]interface{}
 func TestParseRulesMap(t *testing.T) {
 
 	var parsetests = []struct {
-		expected []*rule
+		expected []*Rule
 		mapval   vals
 	}{
 		{
-			expected: []*rule{
-				&rule{
-					Name:    "001",
-					Match:   "*.amazon.com",
-					Enabled: true,
-					Action:  "permit",
+			expected: []*Rule{
+				&Rule{
+					Name:     "001",
+					Match:    `\.amazon\.com$`,
+					Enabled:  true,
+					Action:   "allow",
+					Priority: 1,
 				},
 			},
 			mapval: vals{
 				"001": vals{
-					"match":   "*.amazon.com",
+					"match":   `\.amazon\.com$`,
 					"enabled": true,
-					"action":  "permit",
+					"action":  "allow",
 				},
 			},
 		},
 	}
 	for _, tt := range parsetests {
 
-		err := LoadRuleset(tt.mapval)
+		rs, err := NewRuleset(tt.mapval)
 
 		assert.Nil(t, err)
-		assert.Equal(t, 1, len(ruleset))
-		assert.True(t, reflect.DeepEqual(tt.expected, ruleset))
+		assert.Equal(t, len(tt.expected), len(rs.Rules()))
 
+		for i, r := range tt.expected {
+			assert.Equal(t, r.Name, rs.Rules()[i].Name)
+			assert.Equal(t, r.Match, rs.Rules()[i].Match)
+			assert.Equal(t, r.Enabled, rs.Rules()[i].Enabled)
+			assert.Equal(t, r.Action, rs.Rules()[i].Action)
+			assert.Equal(t, r.Priority, rs.Rules()[i].Priority)
+		}
 	}
 
 }
+
+func TestRulesetOrder(t *testing.T) {
+
+	var ordertests = []struct {
+		mapval   vals
+		expected []string
+		err      string
+	}{
+		{
+			mapval: vals{
+				"003": vals{"match": ".*", "action": "deny"},
+				"001": vals{"match": "amazonaws.com$", "action": "allow"},
+				"002": vals{"match": "^github.com$", "action": "allow"},
+			},
+			expected: []string{"001", "002", "003"},
+		},
+		{
+			mapval: vals{
+				"catchall": vals{"match": ".*", "action": "deny", "priority": 100},
+				"github":   vals{"match": "^github.com$", "action": "allow", "priority": 10},
+				"005":      vals{"match": "amazonaws.com$", "action": "allow"},
+			},
+			expected: []string{"005", "github", "catchall"},
+		},
+		{
+			mapval: vals{
+				"001":    vals{"match": ".*", "action": "deny"},
+				"github": vals{"match": "^github.com$", "action": "allow", "priority": 1},
+			},
+			err: "Rules 001 and github have the same priority 1",
+		},
+		{
+			mapval: vals{
+				"github": vals{"match": "^github.com$", "action": "allow"},
+			},
+			err: "Rule github has no priority and the name is not a number",
+		},
+	}
+
+	for _, tt := range ordertests {
+
+		rs, err := NewRuleset(tt.mapval)
+
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+
+		assert.Nil(t, err)
+
+		names := []string{}
+		for _, r := range rs.Rules() {
+			names = append(names, r.Name)
+		}
+
+		assert.Equal(t, tt.expected, names)
+	}
+}
+
+func TestMatchRuleActive(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": "^github.com$", "action": "deny", "enabled": false},
+		"002": vals{"match": "^github.com$", "action": "deny", "expires": "2016-01-01", "owner": "security", "ticket": "SEC-1"},
+		"003": vals{"match": "^github.com$", "action": "allow", "expires": "2999-01-01T00:00:00Z"},
+	})
+	assert.Nil(t, err)
+
+	rm := rs.MatchRule("github.com")
+	assert.NotNil(t, rm)
+	assert.Equal(t, "003", rm.Rule.Name)
+	assert.Equal(t, ActionAccept, rm.Action)
+}
+
+func TestMatchRuleMonitor(t *testing.T) {
+
+	rs := &Ruleset{}
+	err := rs.LoadConfig(RulesetConfig{
+		Rules: vals{
+			"001": vals{"exact": "github.com", "action": "monitor"},
+			"002": vals{"exact": "github.com", "action": "deny"},
+			"003": vals{"exact": "gitlab.com", "action": "monitor"},
+		},
+		DefaultAction: "deny",
+	})
+	assert.Nil(t, err)
+
+	// the monitor rule is skipped so the deny rule below it still decides
+	rm := rs.MatchRule("github.com")
+	assert.NotNil(t, rm)
+	assert.Equal(t, "002", rm.Rule.Name)
+	assert.Equal(t, ActionReject, rm.Action)
+
+	rm = rs.MatchRule("gitlab.com")
+	assert.NotNil(t, rm)
+	assert.Nil(t, rm.Rule)
+	assert.Equal(t, ActionReject, rm.Action)
+	assert.True(t, rm.Default)
+}
+
+func TestParseRuleExpires(t *testing.T) {
+
+	_, err := NewRuleset(vals{
+		"001": vals{"match": "^github.com$", "action": "allow", "expires": "next week"},
+	})
+	assert.EqualError(t, err, "Rule has an invalid expiry: next week")
+}
+
+func TestParseRuleAlert(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "github.com", "action": "deny", "alert": "unrecognized_name"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, alertUnrecognizedName, rs.MatchRule("github.com").alert())
+
+	// close_notify isn't an error so it can't be sent as a fatal alert
+	_, err = NewRuleset(vals{
+		"001": vals{"exact": "github.com", "action": "deny", "alert": "close_notify"},
+	})
+	assert.EqualError(t, err, "Rule has an invalid alert: close_notify")
+}
+
+func TestReloadRuleset(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"match": "^github.com$", "action": "allow"},
+		"002": vals{"match": ".*", "action": "deny"},
+	})
+	assert.Nil(t, err)
+
+	// reloading replaces the rules rather than appending
+	err = rs.LoadConfig(RulesetConfig{Rules: vals{
+		"001": vals{"match": "^github.com$", "action": "deny"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rs.Rules()))
+	assert.Equal(t, ActionReject, rs.MatchRule("github.com").Action)
+
+	// an invalid config keeps the existing rules
+	err = rs.LoadConfig(RulesetConfig{Rules: vals{
+		"001": vals{"match": "^github.com$", "action": "allow"},
+		"002": vals{"match": "(", "action": "deny"},
+	}})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(rs.Rules()))
+	assert.Equal(t, ActionReject, rs.MatchRule("github.com").Action)
+}
+
+func TestDefaultRuleset(t *testing.T) {
+
+	// the package level functions share a ruleset, put it back for other tests
+	saved := defaultRuleset
+	defaultRuleset = &Ruleset{}
+	t.Cleanup(func() { defaultRuleset = saved })
+
+	err := LoadRuleset(vals{
+		"001": vals{"match": "^github.com$", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	rm := MatchRule("github.com")
+	assert.NotNil(t, rm)
+	assert.Equal(t, ActionAccept, rm.Action)
+
+	assert.Nil(t, MatchRule("gitlab.com"))
+}
+
+func TestMatchRuleIndexedPriority(t *testing.T) {
+
+	rs, err := NewRuleset(vals{
+		"001": vals{"exact": "api.github.com", "action": "allow"},
+		"002": vals{"match": "github", "action": "deny"},
+		"003": vals{"suffix": "github.com", "action": "allow"},
+		"004": vals{"wildcard": "*.example.com", "action": "deny"},
+		"005": vals{"suffix": ".example.com", "action": "allow"},
+	})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		host string
+		name string
+	}{
+		{host: "api.github.com", name: "001"},
+		{host: "www.github.com", name: "002"},
+		{host: "www.example.com", name: "004"},
+		{host: "a.www.example.com", name: "005"},
+	}
+
+	for _, tt := range matchtests {
+		rm := rs.MatchRule(tt.host)
+		assert.NotNil(t, rm, tt.host)
+		assert.Equal(t, tt.name, rm.Rule.Name, tt.host)
+	}
+
+	assert.Nil(t, rs.MatchRule("example.com"))
+}
+
+// benchmarkRules build a ruleset of n suffix rules with a catch all deny
+func benchmarkRules(b *testing.B, n int) *Ruleset {
+	rules := vals{}
+	for i := 0; i < n; i++ {
+		rules[fmt.Sprintf("%06d", i)] = vals{"suffix": fmt.Sprintf("domain%d.example.com", i), "action": "allow"}
+	}
+	rules[fmt.Sprintf("%06d", n)] = vals{"match": ".*", "action": "deny"}
+
+	rs, err := NewRuleset(rules)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return rs
+}
+
+// matchLinear the previous MatchRule which tests every rule in turn
+func matchLinear(rs *Ruleset, host string) *Rule {
+	for _, r := range rs.Rules() {
+		if r.matcher.matchHost(host) {
+			return r
+		}
+	}
+	return nil
+}
+
+func BenchmarkMatchRule(b *testing.B) {
+	for _, n := range []int{10, 1000, 50000} {
+		rs := benchmarkRules(b, n)
+		host := fmt.Sprintf("www.domain%d.example.com", n-1)
+
+		b.Run(fmt.Sprintf("indexed-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rs.MatchRule(host)
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matchLinear(rs, host)
+			}
+		})
+	}
+}
+
+func TestDefaultAction(t *testing.T) {
+
+	rs := &Ruleset{}
+	err := rs.LoadConfig(RulesetConfig{
+		Rules: vals{
+			"001": vals{"exact": "github.com", "action": "deny"},
+		},
+		DefaultAction: "allow",
+	})
+	assert.Nil(t, err)
+
+	rm := rs.MatchRule("github.com")
+	assert.Equal(t, ActionReject, rm.Action)
+	assert.False(t, rm.Default)
+
+	rm = rs.MatchRule("gitlab.com")
+	assert.NotNil(t, rm)
+	assert.Nil(t, rm.Rule)
+	assert.Equal(t, ActionAccept, rm.Action)
+	assert.True(t, rm.Default)
+
+	// a hostname which can't be normalised is rejected whatever the default
+	rm = rs.MatchRule("xn--zz.example")
+	assert.Equal(t, ActionReject, rm.Action)
+	assert.False(t, rm.Default)
+	assert.Equal(t, "invalid hostname", rm.Reason)
+
+	err = rs.LoadConfig(RulesetConfig{DefaultAction: "monitor"})
+	assert.Nil(t, err)
+	assert.Equal(t, ActionMonitor, rs.MatchRule("gitlab.com").Action)
+
+	err = rs.LoadConfig(RulesetConfig{DefaultAction: "permit"})
+	assert.EqualError(t, err, "Ruleset has an invalid default action: permit")
+}
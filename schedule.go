@@ -0,0 +1,194 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minutesPerDay the end of a time range covering the rest of the day, 24:00
+const minutesPerDay = 24 * 60
+
+// timeRange minutes since midnight, a range where end is before start wraps
+// past midnight into the next day
+type timeRange struct {
+	start, end int
+}
+
+// schedule the days and times a rule is active in a timezone
+type schedule struct {
+	days     [7]bool
+	times    []timeRange
+	location *time.Location
+}
+
+// buildSchedule compile the schedule of the rule, a rule without days or times
+// is always active
+func (r *Rule) buildSchedule() error {
+
+	r.schedule = nil
+
+	if len(r.Days) == 0 && len(r.Times) == 0 {
+		if r.Timezone != "" || r.Terminate {
+			return fmt.Errorf("Rule %s has a timezone or terminate without days or times", r.Name)
+		}
+		return nil
+	}
+
+	sc := &schedule{location: time.UTC}
+
+	if r.Timezone != "" {
+		loc, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			return fmt.Errorf("Rule %s has an invalid timezone: %s", r.Name, r.Timezone)
+		}
+		sc.location = loc
+	}
+
+	if len(r.Days) == 0 {
+		sc.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	for _, d := range r.Days {
+		wd, ok := parseWeekday(d)
+		if !ok {
+			return fmt.Errorf("Rule %s has an invalid day: %s", r.Name, d)
+		}
+		sc.days[wd] = true
+	}
+
+	for _, t := range r.Times {
+		tr, ok := parseTimeRange(t)
+		if !ok {
+			return fmt.Errorf("Rule %s has an invalid time range: %s", r.Name, t)
+		}
+		sc.times = append(sc.times, tr)
+	}
+
+	if len(sc.times) == 0 {
+		sc.times = []timeRange{{start: 0, end: minutesPerDay}}
+	}
+
+	r.schedule = sc
+
+	return nil
+}
+
+// parseWeekday accept the english name of the day or the first three letters
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if day == name || day == name[:3] {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// parseTimeRange accept a range of the form 09:00-17:00, the end can be 24:00
+// and a range ending before it starts, 22:00-02:00, runs past midnight
+func parseTimeRange(s string) (timeRange, bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return timeRange{}, false
+	}
+
+	start, ok := parseClock(strings.TrimSpace(parts[0]))
+	if !ok || start == minutesPerDay {
+		return timeRange{}, false
+	}
+
+	end, ok := parseClock(strings.TrimSpace(parts[1]))
+	if !ok || end == start {
+		return timeRange{}, false
+	}
+
+	return timeRange{start: start, end: end}, true
+}
+
+// parseClock the minutes since midnight of a time such as 17:30
+func parseClock(s string) (int, bool) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || err != nil || len(s) != 5 {
+		return 0, false
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// window find the end of the window containing t, false is returned when t is
+// outside the schedule
+func (sc *schedule) window(t time.Time) (time.Time, bool) {
+	t = t.In(sc.location)
+
+	y, m, d := t.Date()
+	minute := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+
+	var end time.Time
+	var found bool
+
+	for _, tr := range sc.times {
+		var e time.Time
+
+		switch {
+		case tr.start < tr.end && sc.days[today] && minute >= tr.start && minute < tr.end:
+			e = sc.clock(y, m, d, tr.end)
+		case tr.start > tr.end && sc.days[today] && minute >= tr.start:
+			e = sc.clock(y, m, d+1, tr.end)
+		case tr.start > tr.end && sc.days[yesterday] && minute < tr.end:
+			e = sc.clock(y, m, d, tr.end)
+		default:
+			continue
+		}
+
+		if !found || e.After(end) {
+			end, found = e, true
+		}
+	}
+
+	return end, found
+}
+
+// clock the wall clock time minutes after midnight on the day, built from the
+// date rather than adding to midnight so it is right on days the clocks change.
+// An end of 24:00 normalises to 00:00 the next day.
+func (sc *schedule) clock(y int, m time.Month, d, minutes int) time.Time {
+	return time.Date(y, m, d, minutes/60, minutes%60, 0, 0, sc.location)
+}
+
+// active check t is inside the schedule
+func (sc *schedule) active(t time.Time) bool {
+	_, ok := sc.window(t)
+	return ok
+}
+
+// closes find when the schedule next ends after t, adjoining windows such as
+// consecutive whole days are followed so a session isn't terminated at the
+// boundary between them. A schedule which never closes returns the zero time.
+func (sc *schedule) closes(t time.Time) time.Time {
+	end, ok := sc.window(t)
+	if !ok {
+		return time.Time{}
+	}
+
+	// a week of adjoining windows covers every day so never closes
+	limit := t.AddDate(0, 0, 8)
+
+	for end.Before(limit) {
+		next, ok := sc.window(end)
+		if !ok || !next.After(end) {
+			return end
+		}
+		end = next
+	}
+
+	return time.Time{}
+}
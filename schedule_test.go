@@ -0,0 +1,127 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeRange(t *testing.T) {
+
+	var rangetests = []struct {
+		s        string
+		expected timeRange
+		ok       bool
+	}{
+		{s: "09:00-17:30", expected: timeRange{start: 540, end: 1050}, ok: true},
+		{s: "22:00-02:00", expected: timeRange{start: 1320, end: 120}, ok: true},
+		{s: "00:00-24:00", expected: timeRange{start: 0, end: 1440}, ok: true},
+		{s: "9:00-17:00"},
+		{s: "09:00-09:00"},
+		{s: "24:00-09:00"},
+		{s: "09:60-17:00"},
+		{s: "09:00"},
+	}
+
+	for _, tt := range rangetests {
+		tr, ok := parseTimeRange(tt.s)
+		assert.Equal(t, tt.ok, ok, tt.s)
+		assert.Equal(t, tt.expected, tr, tt.s)
+	}
+}
+
+func TestMatchSchedule(t *testing.T) {
+
+	now := time.Date(2016, 6, 6, 8, 0, 0, 0, time.UTC) // a monday
+
+	rs := &Ruleset{Clock: func() time.Time { return now }}
+	err := rs.LoadConfig(RulesetConfig{Rules: vals{
+		"001": vals{"exact": "support.vendor.com", "action": "allow", "days": []string{"mon", "Tuesday"}, "times": []string{"09:00-17:00"}, "timezone": "Australia/Melbourne", "terminate": true},
+		"002": vals{"exact": "backup.vendor.com", "action": "allow", "times": []string{"22:00-02:00"}},
+		"003": vals{"match": ".*", "action": "deny"},
+	}})
+	assert.Nil(t, err)
+
+	var matchtests = []struct {
+		now   time.Time
+		host  string
+		name  string
+		until time.Time
+	}{
+		// 18:00 monday in melbourne
+		{now: time.Date(2016, 6, 6, 8, 0, 0, 0, time.UTC), host: "support.vendor.com", name: "003"},
+		// 10:00 tuesday in melbourne
+		{now: time.Date(2016, 6, 7, 0, 0, 0, 0, time.UTC), host: "support.vendor.com", name: "001", until: time.Date(2016, 6, 7, 7, 0, 0, 0, time.UTC)},
+		// 10:00 wednesday in melbourne
+		{now: time.Date(2016, 6, 8, 0, 0, 0, 0, time.UTC), host: "support.vendor.com", name: "003"},
+		{now: time.Date(2016, 6, 8, 23, 0, 0, 0, time.UTC), host: "backup.vendor.com", name: "002"},
+		{now: time.Date(2016, 6, 9, 1, 0, 0, 0, time.UTC), host: "backup.vendor.com", name: "002"},
+		{now: time.Date(2016, 6, 9, 2, 0, 0, 0, time.UTC), host: "backup.vendor.com", name: "003"},
+	}
+
+	for _, tt := range matchtests {
+		now = tt.now
+		rm := rs.MatchRule(tt.host)
+		assert.NotNil(t, rm, tt.now.String())
+		assert.Equal(t, tt.name, rm.Rule.Name, tt.now.String())
+		assert.True(t, tt.until.Equal(rm.Until), rm.Until.String())
+	}
+
+	_, err = NewRuleset(vals{
+		"001": vals{"exact": "github.com", "action": "allow", "days": []string{"someday"}},
+	})
+	assert.EqualError(t, err, "Rule 001 has an invalid day: someday")
+}
+
+func TestScheduleCloses(t *testing.T) {
+
+	r := &Rule{Name: "001", Days: []string{"mon", "tue"}, Times: []string{"00:00-24:00"}}
+	assert.Nil(t, r.buildSchedule())
+
+	// adjoining days are followed through to the end of tuesday
+	closes := r.schedule.closes(time.Date(2016, 6, 6, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2016, 6, 8, 0, 0, 0, 0, time.UTC), closes)
+
+	// a schedule covering the whole week never closes
+	r = &Rule{Name: "002", Times: []string{"00:00-24:00"}}
+	assert.Nil(t, r.buildSchedule())
+	assert.True(t, r.schedule.closes(time.Date(2016, 6, 6, 12, 0, 0, 0, time.UTC)).IsZero())
+}
+
+func TestScheduleDST(t *testing.T) {
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("timezone data not available: %s", err)
+	}
+
+	r := &Rule{Name: "001", Times: []string{"09:00-17:00"}, Timezone: "Europe/London"}
+	assert.Nil(t, r.buildSchedule())
+
+	var dsttests = []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		// the clocks go forward an hour at 01:00 UTC
+		{now: time.Date(2026, 3, 29, 10, 0, 0, 0, london), expected: time.Date(2026, 3, 29, 16, 0, 0, 0, time.UTC)},
+		// the clocks go back an hour at 01:00 UTC
+		{now: time.Date(2026, 10, 25, 10, 0, 0, 0, london), expected: time.Date(2026, 10, 25, 17, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range dsttests {
+		closes := r.schedule.closes(tt.now)
+		assert.True(t, tt.expected.Equal(closes), "%s closes at %s", tt.now, closes.UTC())
+	}
+
+	// a window ending at 24:00 ends at midnight local time
+	r = &Rule{Name: "002", Days: []string{"sun"}, Times: []string{"20:00-24:00"}, Timezone: "Europe/London"}
+	assert.Nil(t, r.buildSchedule())
+
+	closes := r.schedule.closes(time.Date(2026, 3, 29, 21, 0, 0, 0, london))
+	assert.True(t, time.Date(2026, 3, 30, 0, 0, 0, 0, london).Equal(closes), closes.String())
+}
@@ -5,42 +5,134 @@ package l7proxify
 // license which can be found in the LICENSE file.
 
 import (
+	"context"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/apex/log"
 )
 
 // A Handler responds to an incoming proxy connection.
 type Handler interface {
-	ProxyConnection(cin *net.TCPConn)
+	ProxyConnection(cin net.Conn)
 }
 
+// keepAlivePeriod how often keepalives are sent on accepted TCP connections so
+// dead clients are eventually dropped
+const keepAlivePeriod = 3 * time.Minute
+
+// minAcceptDelay and maxAcceptDelay bound the backoff between failed accepts
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
 // Server the core of the proxy server
 type Server struct {
+	// Addr the local listen address
+	Addr string
+	// Handler invoked for each accepted connection
+	Handler Handler
+	// Transparent listen with IP_TRANSPARENT set so connections redirected
+	// using TPROXY can be accepted, linux only and requires CAP_NET_ADMIN
+	Transparent bool
 }
 
 // ListenAndServe listen and start proxying connections
 func ListenAndServe(addr string, handler Handler) error {
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServe()
+}
 
-	laddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return err
-	}
+// ListenAndServe listen on the servers address and start proxying connections
+func (srv *Server) ListenAndServe() error {
 
-	l, err := net.ListenTCP("tcp", laddr)
+	l, err := srv.listen()
 	if err != nil {
 		return err
 	}
 	defer l.Close()
 
+	log.WithFields(log.Fields{
+		"addr":        l.Addr().String(),
+		"transparent": srv.Transparent,
+	}).Info("listening")
+
+	return srv.Serve(l)
+}
+
+// listen open the TCP listener on the servers address, with IP_TRANSPARENT set
+// in transparent mode
+func (srv *Server) listen() (net.Listener, error) {
+
+	lc := &net.ListenConfig{}
+
+	if srv.Transparent {
+		lc.Control = transparentControl
+	}
+
+	return lc.Listen(context.Background(), "tcp", srv.Addr)
+}
+
+// Serve accept connections on the listener and pass them to the handler, any
+// listener can be used such as a unix socket or one which unwraps the PROXY
+// protocol. TCP keepalive is enabled on connections which support it.
+//
+// When accept fails, for example when the process runs out of file
+// descriptors, it is retried with a backoff like net/http rather than
+// spinning.
+func (srv *Server) Serve(l net.Listener) error {
+
+	// handlers which dial the original destination need the listener's
+	// address so they don't dial themselves
+	if la, ok := srv.Handler.(listenAddrAdder); ok {
+		la.addListenAddr(l.Addr())
+	}
+
+	var delay time.Duration
+
 	for {
 		// Wait for a connection.
-		conn, err := l.AcceptTCP()
+		conn, err := l.Accept()
 		if err != nil {
-			log.WithError(err).Error("accept failed")
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+
+			log.WithError(err).WithField("retryIn", delay).Error("accept failed")
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+
+		if kc, ok := conn.(keepAliveConn); ok {
+			kc.SetKeepAlive(true)
+			kc.SetKeepAlivePeriod(keepAlivePeriod)
 		}
 
 		// Handle the connection in a new goroutine.
-		go handler.ProxyConnection(conn)
+		go srv.Handler.ProxyConnection(conn)
 	}
 }
+
+// listenAddrAdder a handler which records the addresses it is served on
+type listenAddrAdder interface {
+	addListenAddr(addr net.Addr)
+}
+
+// keepAliveConn a connection which supports TCP keepalive, like *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
@@ -0,0 +1,80 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type handlerFunc func(cin net.Conn)
+
+func (f handlerFunc) ProxyConnection(cin net.Conn) { f(cin) }
+
+func TestServerUnix(t *testing.T) {
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "l7proxify.sock"))
+	if err != nil {
+		t.Skipf("unix listener not available: %s", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan string, 1)
+
+	srv := &Server{
+		Handler: handlerFunc(func(cin net.Conn) {
+			accepted <- cin.LocalAddr().Network()
+			cin.Close()
+		}),
+	}
+
+	go srv.Serve(l)
+
+	c, err := net.Dial("unix", l.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	select {
+	case network := <-accepted:
+		assert.Equal(t, "unix", network)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
+
+// failingListener fails to accept a number of times then reports it is closed
+type failingListener struct {
+	net.Listener
+	failures int
+	accepts  []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts = append(l.accepts, time.Now())
+	if len(l.accepts) > l.failures {
+		return nil, net.ErrClosed
+	}
+	return nil, syscall.EMFILE
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+
+	l := &failingListener{failures: 5}
+
+	srv := &Server{Handler: handlerFunc(func(cin net.Conn) {})}
+
+	err := srv.Serve(l)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Equal(t, 6, len(l.accepts))
+
+	// 5ms, 10ms, 20ms, 40ms then 80ms between attempts
+	assert.True(t, l.accepts[5].Sub(l.accepts[0]) >= 155*time.Millisecond, l.accepts[5].Sub(l.accepts[0]).String())
+	assert.True(t, l.accepts[5].Sub(l.accepts[4]) >= 80*time.Millisecond)
+}
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"syscall"
+)
+
+// IPV6_TRANSPARENT from linux/in6.h, this isn't exported by the syscall package
+const ipv6Transparent = 75
+
+// transparentControl enable IP_TRANSPARENT on a socket before it is bound,
+// this is required to accept connections redirected using TPROXY and to bind
+// upstream connections to a non local (spoofed) source address.
+//
+// Setting this option requires CAP_NET_ADMIN.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+
+	err := c.Control(func(fd uintptr) {
+		switch network {
+		case "tcp6":
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		default:
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// ipTransparent read back the IP_TRANSPARENT option of the socket
+func ipTransparent(t *testing.T, c syscall.Conn) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		v       int
+		sockErr error
+	)
+
+	err = rc.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+
+	return v
+}
+
+func TestServerTransparent(t *testing.T) {
+
+	accepted := make(chan net.Addr, 1)
+
+	srv := &Server{
+		Addr: "127.0.0.1:0",
+		Handler: handlerFunc(func(cin net.Conn) {
+			accepted <- cin.LocalAddr()
+			cin.Close()
+		}),
+		Transparent: true,
+	}
+
+	l, err := srv.listen()
+	if err != nil {
+		// needs CAP_NET_ADMIN, run as root in a network namespace with
+		// unshare -rn go test -run TestServerTransparent
+		t.Skipf("transparent listener not available: %s", err)
+	}
+	defer l.Close()
+
+	assert.Equal(t, 1, ipTransparent(t, l.(*net.TCPListener)))
+
+	// without transparent mode the option is left off
+	plain, err := (&Server{Addr: "127.0.0.1:0"}).listen()
+	assert.Nil(t, err)
+	defer plain.Close()
+
+	assert.Equal(t, 0, ipTransparent(t, plain.(*net.TCPListener)))
+
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	select {
+	case addr := <-accepted:
+		assert.Equal(t, l.Addr().String(), addr.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
+
+func TestSpoofSource(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the client connection the session spoofs the address of
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	cin, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cin.Close()
+
+	for _, spoof := range []bool{true, false} {
+		s := &Session{
+			handler: &TLSHandler{SpoofSource: spoof},
+			lconn:   NewConn(cin),
+			Log:     log.Log,
+		}
+
+		d, err := s.dialer()
+		assert.Nil(t, err)
+
+		c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			// needs CAP_NET_ADMIN like the transparent listener
+			t.Skipf("transparent dial not available: %s", err)
+		}
+
+		expected := 0
+		if spoof {
+			expected = 1
+		}
+
+		assert.Equal(t, expected, ipTransparent(t, c.(*net.TCPConn)), spoof)
+		c.Close()
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// transparentControl is only supported on linux which provides TPROXY.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("transparent sockets not supported on this platform")
+}
@@ -0,0 +1,112 @@
+package l7proxify
+
+// Copyright 2016 Mark Wolfe. All rights reserved.
+// Use of this source code is governed by the MIT
+// license which can be found in the LICENSE file.
+
+import (
+	"sort"
+	"strings"
+)
+
+// domainTrie indexes exact and suffix rules by their labels in reverse order,
+// com -> amazonaws -> s3, so a lookup walks the labels of the hostname once
+// rather than testing every rule.
+type domainTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// exact rules matching the name of this node
+	exact []int
+	// suffix rules matching any subdomain of this node
+	suffix []int
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}}
+}
+
+// insert add the rule at position idx in the ruleset to the trie, returning
+// false if the rule can't be indexed and needs to be scanned.
+func (t *domainTrie) insert(idx int, m hostMatcher) bool {
+	switch m := m.(type) {
+	case *exactMatcher:
+		n := t.node(m.host)
+		n.exact = append(n.exact, idx)
+	case *suffixMatcher:
+		n := t.node(m.domain)
+		if !m.subdomains {
+			n.exact = append(n.exact, idx)
+		}
+		n.suffix = append(n.suffix, idx)
+	case *domainListMatcher:
+		for host := range m.exact {
+			n := t.node(host)
+			n.exact = append(n.exact, idx)
+		}
+		for domain := range m.suffix {
+			n := t.node(domain)
+			n.suffix = append(n.suffix, idx)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// node find or create the node for the domain
+func (t *domainTrie) node(domain string) *trieNode {
+	n := t.root
+
+	labels := strings.Split(domain, ".")
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = map[string]*trieNode{}
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &trieNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+
+	return n
+}
+
+// lookup return the positions of the rules matching the hostname in
+// ascending order.
+func (t *domainTrie) lookup(host string) []int {
+	var matches []int
+
+	n := t.root
+
+	labels := strings.Split(host, ".")
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			break
+		}
+		if i == 0 {
+			matches = append(matches, n.exact...)
+		} else {
+			matches = append(matches, n.suffix...)
+		}
+	}
+
+	sort.Ints(matches)
+
+	// a domain list rule can match at more than one node
+	for i := 1; i < len(matches); i++ {
+		if matches[i] == matches[i-1] {
+			matches = append(matches[:i], matches[i+1:]...)
+			i--
+		}
+	}
+
+	return matches
+}